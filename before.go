@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"bitbucket.org/creachadair/shell"
+)
+
+// runBefore runs the command described by cmdline until it succeeds, trying
+// at most retries more times after the first failure and waiting interval
+// between attempts. It reports an error if the command never succeeds.
+func runBefore(cmdline []string, retries int, interval time.Duration) error {
+	for try := 0; ; try++ {
+		diag("Running before command: %s", shell.Join(cmdline))
+		proc := exec.Command(cmdline[0], cmdline[1:]...)
+		proc.Stdout = cmdOutput
+		proc.Stderr = cmdErrors
+		err := prepareProc(proc)
+		if err == nil {
+			err = proc.Run()
+		}
+		if err == nil {
+			return nil
+		} else if try >= retries {
+			return fmt.Errorf("%q failed after %d attempts: %w", cmdline[0], try+1, err)
+		}
+		diag("Before command %q failed (%v); retrying in %v", cmdline[0], err, interval)
+		time.Sleep(interval)
+	}
+}
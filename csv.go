@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// A csvFile writes a CSV row for each match to a file, for -csv. The columns
+// are the trigger number, the matched text, and the submatches of all the
+// triggers by name (or by index, if unnamed), in order of first appearance.
+// The triggers include any -file-trigger triggers, whose matched text is the
+// file path.
+// Submatches that a trigger does not define or that did not participate in
+// the match are empty.
+type csvFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *csv.Writer
+	closed bool
+	cols   map[string]int // column index by submatch name
+	ncol   int
+}
+
+// openCSVFile creates or truncates the file at path for writing CSV rows for
+// the given triggers, and writes the header row.
+func openCSVFile(path string, trigs []*trigger) (*csvFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &csvFile{f: f, w: csv.NewWriter(f), cols: make(map[string]int)}
+	header := []string{"trigger", "match"}
+	for _, t := range trigs {
+		for i := range t.re.SubexpNames()[1:] {
+			name := csvName(t, i+1)
+			if _, ok := c.cols[name]; !ok {
+				c.cols[name] = len(header)
+				header = append(header, name)
+			}
+		}
+	}
+	c.ncol = len(header)
+	if err := c.w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	atInterrupt(c.flush)
+	return c, nil
+}
+
+// csvName returns the column name for submatch i of the pattern of t.
+func csvName(t *trigger, i int) string {
+	if name := t.re.SubexpNames()[i]; name != "" {
+		return name
+	}
+	return strconv.Itoa(i)
+}
+
+// record writes a row for the match m in text of trigger t.
+func (c *csvFile) record(t *trigger, m []int, text string) error {
+	row := make([]string, c.ncol)
+	row[0] = strconv.Itoa(t.id)
+	row[1] = text[m[0]:m[1]]
+	for i := 1; 2*i+1 < len(m); i++ {
+		if m[2*i] >= 0 {
+			row[c.cols[csvName(t, i)]] = text[m[2*i]:m[2*i+1]]
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(row)
+}
+
+// flush writes any buffered rows to the file, unless it is closed.
+func (c *csvFile) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.w.Flush()
+	}
+}
+
+// Close flushes buffered rows and closes the file.
+func (c *csvFile) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.w.Flush()
+	return errors.Join(c.w.Error(), c.f.Close())
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// Running commands as another user is not supported on this platform.
+func userAttr(name string) (*syscall.SysProcAttr, error) {
+	return nil, errors.New("running commands as another user is not supported on this platform")
+}
+
+// Setting the umask for commands is not supported on this platform.
+func withUmask(proc *exec.Cmd, umask string) error {
+	return errors.New("setting the umask for commands is not supported on this platform")
+}
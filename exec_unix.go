@@ -0,0 +1,46 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// userAttr returns process attributes that run a command as the named user,
+// with the user's primary group.
+func userAttr(name string) (*syscall.SysProcAttr, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}, nil
+}
+
+// withUmask rewrites proc to run under the given umask (in octal), by way of
+// the shell. Commands that could not be found are left alone, so that the
+// error is reported for the original command.
+func withUmask(proc *exec.Cmd, umask string) error {
+	if proc.Err != nil {
+		return nil
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return err
+	}
+	args := append([]string{"sh", "-c", `umask ` + umask + ` && exec "$0" "$@"`, proc.Path}, proc.Args[1:]...)
+	proc.Path, proc.Args = sh, args
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A match records a match of a trigger's pattern, for expanding templates.
+type match struct {
+	m       []int     // submatch indices in text
+	text    string    // the text containing the match
+	when    time.Time // when the trigger fired for the match
+	count   int       // the number of matches represented (for -collapse)
+	context string    // the input preceding text (for -pipe-context)
+	seq     int64     // the sequence number of the firing
+	source  string    // the name of the input file containing the match
+	line    int       // the line number of the match in source (for -template)
+	offset  int64     // the input offset of the match (for -template)
+}
+
+// expand returns the expansion of tmpl for the match x of the trigger's
+// pattern.
+//
+// The syntax follows regexp.Regexp.Expand: $name or ${name} is replaced by the
+// text of the named or numbered submatch, $$ is a literal "$", and a "$" that
+// does not begin a valid reference is copied verbatim. Escapes are recognized
+// from left to right, so "$$1" is the literal "$1" and "$$$1" is "$" followed
+// by the first submatch. An unbraced name is as long as possible, so "$1x"
+// refers to the submatch named "1x", not "$1" followed by "x". The braced
+// form may include a directive, ${name:directive}, to transform the value:
+//
+//	json  -- the value encoded as a JSON string, including quotes
+//	line  -- the line of the match on which the submatch begins, from 1
+//
+// Special variables with upper-case names give information about the match
+// other than submatches; see special. A submatch with the same name as a
+// special variable takes precedence over it.
+func (t *trigger) expand(tmpl string, x *match) string {
+	s, _ := t.expandCheck(tmpl, x, nil)
+	return s
+}
+
+// expandCheck is as expand, but if check != nil it is applied to the value
+// substituted for each reference in tmpl, and its first error is returned.
+func (t *trigger) expandCheck(tmpl string, x *match, check func(val string) error) (string, error) {
+	var sb strings.Builder
+	add := func(val string) error {
+		if check != nil {
+			if err := check(val); err != nil {
+				return err
+			}
+		}
+		sb.WriteString(val)
+		return nil
+	}
+	for {
+		i := strings.IndexByte(tmpl, '$')
+		if i < 0 {
+			break
+		}
+		sb.WriteString(tmpl[:i])
+		tmpl = tmpl[i+1:]
+		if strings.HasPrefix(tmpl, "$") {
+			sb.WriteByte('$')
+			tmpl = tmpl[1:]
+			continue
+		}
+		ref, rest, ok := parseRef(tmpl)
+		if !ok {
+			sb.WriteByte('$') // malformed; treat as raw text
+			continue
+		}
+		tmpl = rest
+		if !hasSubmatch(t.re, ref.name) {
+			if val, ok := t.special(ref, x); ok {
+				if err := add(val); err != nil {
+					return "", err
+				}
+				continue
+			}
+		}
+		val := t.submatch(ref.name, x.text, x.m)
+		switch ref.verb {
+		case "json":
+			val = jsonString(val)
+		case "line":
+			val = t.submatchLine(ref.name, x.text, x.m)
+		}
+		if err := add(val); err != nil {
+			return "", err
+		}
+	}
+	sb.WriteString(tmpl)
+	return sb.String(), nil
+}
+
+// expandPath returns the expansion of the -cout path tmpl for the match x.
+// It reports an error if a value substituted into tmpl contains a path
+// separator, or if it makes a component of the path "." or "..", so that a
+// match cannot name a file outside the directories given by tmpl.
+func (t *trigger) expandPath(tmpl string, x *match) (string, error) {
+	path, err := t.expandCheck(tmpl, x, func(val string) error {
+		if strings.ContainsRune(val, '/') || strings.ContainsRune(val, filepath.Separator) {
+			return fmt.Errorf("value %q contains a path separator", val)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Since values cannot contain separators, the components of the path
+	// correspond to those of the template.
+	want := strings.Split(filepath.ToSlash(tmpl), "/")
+	for i, elt := range strings.Split(filepath.ToSlash(path), "/") {
+		if (elt == "." || elt == "..") && want[i] != elt {
+			return "", fmt.Errorf("path %q has a %q component from a value", path, elt)
+		}
+	}
+	return path, nil
+}
+
+// special returns the value of the special variable denoted by ref for the
+// match x, or false if ref does not name a special variable:
+//
+//	$NOW  -- the time of firing, in RFC 3339 format
+//	${NOW:layout}  -- the time of firing, in the given time.Format layout
+//	$PATTERN  -- the trigger's regular expression
+//	$COUNT  -- the number of matches represented by x
+//	$SEQ  -- the sequence number of the firing, in order of dispatch
+//	$SOURCE  -- the name of the input file containing the match
+//	$LEN  -- the length of the match in bytes
+func (t *trigger) special(ref reference, x *match) (string, bool) {
+	switch ref.name {
+	case "PATTERN":
+		return t.re.String(), true
+	case "COUNT":
+		return strconv.Itoa(x.count), true
+	case "SEQ":
+		return strconv.FormatInt(x.seq, 10), true
+	case "SOURCE":
+		return x.source, true
+	case "LEN":
+		return strconv.Itoa(x.m[1] - x.m[0]), true
+	case "NOW":
+		if ref.verb == "" {
+			return x.when.Format(time.RFC3339), true
+		}
+		return x.when.Format(ref.verb), true
+	}
+	return "", false
+}
+
+// isSpecialName reports whether name is the name of a special variable.
+func isSpecialName(name string) bool {
+	switch name {
+	case "PATTERN", "COUNT", "SEQ", "SOURCE", "LEN", "NOW":
+		return true
+	}
+	return false
+}
+
+// isSpecial reports whether name is the name of a special variable whose
+// directive is interpreted by the variable itself.
+func isSpecial(name string) bool { return name == "NOW" }
+
+// jsonString returns s encoded as a JSON string. Unlike json.Marshal, it does
+// not escape HTML metacharacters.
+func jsonString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s) // cannot fail for a string
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// checkTemplate reports an error if tmpl contains a reference with an unknown
+// directive.
+func checkTemplate(tmpl string) error {
+	for {
+		i := strings.IndexByte(tmpl, '$')
+		if i < 0 {
+			return nil
+		}
+		tmpl = tmpl[i+1:]
+		if strings.HasPrefix(tmpl, "$") {
+			tmpl = tmpl[1:]
+			continue
+		}
+		ref, rest, ok := parseRef(tmpl)
+		if !ok {
+			continue
+		}
+		tmpl = rest
+		switch {
+		case ref.verb == "", ref.verb == "json", ref.verb == "line", isSpecial(ref.name):
+		default:
+			return fmt.Errorf("unknown directive %q in ${%s:%s}", ref.verb, ref.name, ref.verb)
+		}
+	}
+}
+
+// checkRefs reports an error if tmpl refers to a submatch that re does not
+// define, other than a special variable.
+func checkRefs(re *regexp.Regexp, tmpl string) error {
+	for {
+		i := strings.IndexByte(tmpl, '$')
+		if i < 0 {
+			return nil
+		}
+		tmpl = tmpl[i+1:]
+		if strings.HasPrefix(tmpl, "$") {
+			tmpl = tmpl[1:]
+			continue
+		}
+		ref, rest, ok := parseRef(tmpl)
+		if !ok {
+			continue
+		}
+		tmpl = rest
+		if !hasSubmatch(re, ref.name) && !isSpecialName(ref.name) {
+			return fmt.Errorf("no submatch %q in pattern", ref.name)
+		}
+	}
+}
+
+// hasRefs reports whether tmpl contains a reference, other than an escaped
+// "$$". Without references, the expansion of tmpl only replaces "$$" by "$".
+func hasRefs(tmpl string) bool {
+	for {
+		i := strings.IndexByte(tmpl, '$')
+		if i < 0 {
+			return false
+		}
+		tmpl = tmpl[i+1:]
+		if strings.HasPrefix(tmpl, "$") {
+			tmpl = tmpl[1:]
+			continue
+		}
+		if _, _, ok := parseRef(tmpl); ok {
+			return true
+		}
+	}
+}
+
+// submatch returns the text of the submatch of m in text denoted by name,
+// which is either a submatch index or the name of a capture group. It returns
+// "" if there is no such submatch, or if it did not participate in the match.
+func (t *trigger) submatch(name, text string, m []int) string {
+	if isDigits(name) {
+		num, err := strconv.Atoi(name)
+		if err == nil && 2*num+1 < len(m) && m[2*num] >= 0 {
+			return text[m[2*num]:m[2*num+1]]
+		}
+		return ""
+	}
+	for i, sub := range t.re.SubexpNames() {
+		if sub == name && 2*i+1 < len(m) && m[2*i] >= 0 {
+			return text[m[2*i]:m[2*i+1]]
+		}
+	}
+	return ""
+}
+
+// submatchLine returns the line number, counting from 1 at the start of the
+// match m in text, on which the submatch denoted by name begins. It returns ""
+// if there is no such submatch, or if it did not participate in the match.
+func (t *trigger) submatchLine(name, text string, m []int) string {
+	i := t.re.SubexpIndex(name)
+	if isDigits(name) {
+		i, _ = strconv.Atoi(name)
+	}
+	if i < 0 || 2*i+1 >= len(m) || m[2*i] < 0 {
+		return ""
+	}
+	return strconv.Itoa(1 + strings.Count(text[m[0]:m[2*i]], "\n"))
+}
+
+// hasSubmatch reports whether re defines a submatch with the given name or
+// index.
+func hasSubmatch(re *regexp.Regexp, name string) bool {
+	if isDigits(name) {
+		num, err := strconv.Atoi(name)
+		return err == nil && num <= re.NumSubexp()
+	}
+	return re.SubexpIndex(name) >= 0
+}
+
+// A reference is a parsed $name, ${name}, or ${name:verb} reference.
+type reference struct {
+	name string // the submatch name or index
+	verb string // the directive, or ""
+}
+
+// parseRef parses a reference from the beginning of s, which follows a "$".
+// It returns the reference and the remainder of s, or ok == false if s does
+// not begin with a valid reference.
+func parseRef(s string) (_ reference, rest string, ok bool) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return reference{}, s, false
+		}
+		name, verb, _ := strings.Cut(s[1:end], ":")
+		if name == "" || wordLen(name) != len(name) {
+			return reference{}, s, false
+		}
+		return reference{name: name, verb: verb}, s[end+1:], true
+	}
+	n := wordLen(s)
+	if n == 0 {
+		return reference{}, s, false
+	}
+	return reference{name: s[:n]}, s[n:], true
+}
+
+// wordLen returns the length of the longest prefix of s consisting of
+// letters, digits, and underscores.
+func wordLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && !('0' <= c && c <= '9') && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') {
+			return i
+		}
+	}
+	return len(s)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// environ returns the environment for a command run for the match x.
+func (t *trigger) environ(x *match) []string {
+	return append(os.Environ(),
+		"TEA_PATTERN="+t.re.String(),
+		"TEA_COUNT="+strconv.Itoa(x.count),
+		"TEA_SEQ="+strconv.FormatInt(x.seq, 10),
+		"TEA_SOURCE="+x.source,
+		"TEA_MATCH_LEN="+strconv.Itoa(x.m[1]-x.m[0]),
+	)
+}
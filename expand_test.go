@@ -0,0 +1,107 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestExpandEscapes(t *testing.T) {
+	re := regexp.MustCompile(`(?P<host>\w+):(\d+)`)
+	const text = "web:80"
+	tr := &trigger{re: re}
+	x := &match{m: re.FindStringSubmatchIndex(text), text: text}
+
+	tests := []struct {
+		tmpl, want string
+	}{
+		{"$$", "$"},
+		{"$$$", "$$"},
+		{"$", "$"},
+		{"x$", "x$"},
+		{"a$$b", "a$b"},
+		{"cost: $$5", "cost: $5"},
+
+		// Escapes are recognized from left to right.
+		{"$$1", "$1"},
+		{"$$$1", "$web"},
+		{"$$$$1", "$$1"},
+		{"$$host", "$host"},
+		{"$${host}", "${host}"},
+		{"$$${host}", "$web"},
+		{"$$NOW", "$NOW"},
+
+		// Escapes adjacent to references.
+		{"$1$$", "web$"},
+		{"${1}$$", "web$"},
+		{"$host$$2", "web$2"},
+		{"${host}$$${2}", "web$80"},
+		{"$1$$$2", "web$80"},
+		{"$$$1$$", "$web$"},
+
+		// An unbraced name is as long as possible.
+		{"$1x", ""},
+		{"${1}x", "webx"},
+		{"$2$$x", "80$x"},
+	}
+	for _, tc := range tests {
+		if got := tr.expand(tc.tmpl, x); got != tc.want {
+			t.Errorf("expand(%q): got %q, want %q", tc.tmpl, got, tc.want)
+		}
+	}
+}
+
+func TestCheckRefsEscapes(t *testing.T) {
+	re := regexp.MustCompile(`(?P<host>\w+):(\d+)`)
+	tests := []struct {
+		tmpl string
+		ok   bool
+	}{
+		{"$$nosuch", true},
+		{"$${nosuch}", true},
+		{"$$$host", true},
+		{"$nosuch", false},
+		{"$$$nosuch", false},
+		{"$$$$nosuch", true},
+		{"${host}$$${nosuch}", false},
+	}
+	for _, tc := range tests {
+		if err := checkRefs(re, tc.tmpl); (err == nil) != tc.ok {
+			t.Errorf("checkRefs(%q): got error %v, want ok=%v", tc.tmpl, err, tc.ok)
+		}
+	}
+}
+
+func TestEscapedCommandArgs(t *testing.T) {
+	// Command output goes to stderr by default.
+	_, stderr, code := runTea(t, "web:80\n", `(\w+):(\d+)`, "echo", "$$1=$1", "$$$2", "$$")
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	if want := "$1=web $80 $\n"; stderr != want {
+		t.Errorf("Command output: got %q, want %q", stderr, want)
+	}
+}
+
+func TestHasRefs(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want bool
+	}{
+		{"", false},
+		{"plain", false},
+		{"$", false},
+		{"s/$/!/", false},
+		{"$$", false},
+		{"$$1", false},
+		{"$${x}", false},
+		{"$1", true},
+		{"${x}", true},
+		{"$$$1", true},
+		{"$NOW", true},
+	}
+	for _, tc := range tests {
+		if got := hasRefs(tc.tmpl); got != tc.want {
+			t.Errorf("hasRefs(%q): got %v, want %v", tc.tmpl, got, tc.want)
+		}
+	}
+}
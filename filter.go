@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+
+	"bitbucket.org/creachadair/shell"
+)
+
+// A filterProc is a long-running command for a -persist trigger. Each match is
+// written to its standard input as a line, and each line of its standard
+// output is copied to the standard output of the program.
+type filterProc struct {
+	proc *exec.Cmd
+	in   io.WriteCloser
+	done chan struct{} // closed when the output has been copied
+}
+
+// startFilter starts the command for a -persist trigger. Its arguments may
+// not refer to submatches, since it is run only once, but may contain "$$" for
+// a literal "$".
+func (t *trigger) startFilter() error {
+	var args []string
+	for _, arg := range t.args {
+		if hasRefs(arg) {
+			return errors.New("persist: command arguments cannot refer to submatches")
+		}
+		args = append(args, strings.ReplaceAll(arg, "$$", "$"))
+	}
+	diag("Starting filter: %s %s", t.cmd, shell.Join(args))
+	proc := t.command(args)
+	proc.Stderr = cmdErrors
+	if err := prepareProc(proc); err != nil {
+		return err
+	}
+	in, err := proc.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := proc.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	f := &filterProc{proc: proc, in: in, done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		rd := bufio.NewReader(out)
+		for {
+			line, err := rd.ReadBytes('\n')
+			if len(line) != 0 {
+				if _, err := stdout.Write(line); err != nil {
+					log.Printf("Error: writing filter output: %v", err)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	t.coproc = f
+	return nil
+}
+
+// send writes text to the filter as a single line.
+func (f *filterProc) send(text string) error {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	_, err := io.WriteString(f.in, text)
+	return err
+}
+
+// stop closes the input of the filter and waits for it to exit and for its
+// output to be copied.
+func (f *filterProc) stop() error {
+	f.in.Close()
+	<-f.done
+	return f.proc.Wait()
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPersistEscapes(t *testing.T) {
+	stdout, stderr, code := runTea(t, "a1\nb\na2\n", "--", "-persist", "a", "sed", "-u", "s/$$/!/")
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	got := strings.Fields(stdout)
+	slices.Sort(got) // the filter output is interleaved as it arrives
+	if want := "a1 a1! a2 a2! b"; strings.Join(got, " ") != want {
+		t.Errorf("Output: got %q, want lines %q", stdout, want)
+	}
+
+	// A reference to a submatch is not allowed.
+	if _, _, code := runTea(t, "", "--", "-persist", "a", "sed", "s/$1/!/"); code == 0 {
+		t.Error("Reference in -persist arguments: unexpectedly succeeded")
+	}
+}
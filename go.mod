@@ -1,5 +1,8 @@
 module github.com/creachadair/tea
 
-go 1.23
+go 1.23.0
 
-require bitbucket.org/creachadair/shell v0.0.8
+require (
+	bitbucket.org/creachadair/shell v0.0.8
+	golang.org/x/text v0.24.0
+)
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"time"
+
+	"bitbucket.org/creachadair/shell"
+)
+
+// startHeartbeat runs the command described by cmdline every interval, until
+// the returned function is called. A run that is still in progress when the
+// next is due delays it, so runs do not overlap. The returned function waits
+// for the run in progress, if any, to finish.
+func startHeartbeat(interval time.Duration, cmdline []string) (stop func()) {
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-tick.C:
+			}
+			diag("Running heartbeat: %s", shell.Join(cmdline))
+			proc := exec.Command(cmdline[0], cmdline[1:]...)
+			proc.Stdout = cmdOutput
+			proc.Stderr = cmdErrors
+			err := prepareProc(proc)
+			if err == nil {
+				err = proc.Run()
+			}
+			if err != nil {
+				log.Printf("Error: heartbeat %q: %v", cmdline[0], err)
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
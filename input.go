@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"bitbucket.org/creachadair/shell"
+)
+
+var (
+	inputFiles   []string   // the values of the -in flag, in order
+	fileRules    [][]string // the values of the -file-trigger flag, split into words
+	fileTriggers []*trigger // the triggers for fileRules, set up by run
+)
+
+func init() {
+	flag.Func("in", "Read input from this file or glob instead of stdin (may be repeated)", func(s string) error {
+		inputFiles = append(inputFiles, s)
+		return nil
+	})
+	flag.Func("file-trigger", "Fire a trigger 'regexp command args...' for each -in file whose path matches (may be repeated)", func(s string) error {
+		// The regexp is taken verbatim, so that its backslashes need not be
+		// quoted; the command and its arguments are split as by the shell.
+		pat, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+		words, ok := shell.Split(rest)
+		if !ok {
+			return fmt.Errorf("invalid quoting in %q", rest)
+		}
+		fileRules = append(fileRules, append([]string{pat}, words...))
+		return nil
+	})
+}
+
+// curInput holds the name of the input file being read.
+var curInput atomic.Value
+
+// setInputName records that name is the input file being read.
+func setInputName(name string) { curInput.Store(name) }
+
+// inputName returns the name of the input file being read, or "-" if input is
+// read from stdin.
+func inputName() string {
+	if name, ok := curInput.Load().(string); ok {
+		return name
+	}
+	return "-"
+}
+
+// matchFile offers path to each of the file triggers, which see it as a line
+// of input. It is called as each input file is opened.
+func matchFile(path string) {
+	for _, t := range fileTriggers {
+		if _, err := t.Write([]byte(path + "\n")); err != nil {
+			log.Printf("File trigger %d: %v", t.id, err)
+		}
+	}
+}
+
+// expandInputs returns the paths of the input files named by args, in order.
+// An argument containing glob metacharacters is replaced by the paths that
+// match it, in sorted order; it is an error if it matches nothing. Other
+// arguments are used verbatim.
+func expandInputs(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, `*?[\`) {
+			paths = append(paths, arg)
+			continue
+		}
+		ms, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", arg, err)
+		} else if len(ms) == 0 {
+			return nil, fmt.Errorf("no files match %q", arg)
+		}
+		paths = append(paths, ms...) // already sorted
+	}
+	return paths, nil
+}
+
+// A fileReader is an io.Reader that concatenates the contents of a sequence
+// of files, opening each only when the previous one is exhausted.
+type fileReader struct {
+	paths []string // the files not yet opened
+	cur   *os.File // the file being read, or nil
+}
+
+// Read implements the io.Reader interface.
+func (r *fileReader) Read(data []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			diag("Reading input from %q", r.paths[0])
+			setInputName(r.paths[0])
+			matchFile(r.paths[0])
+			r.cur, r.paths = f, r.paths[1:]
+		}
+		nr, err := r.cur.Read(data)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if nr == 0 {
+				continue
+			}
+			err = nil
+		}
+		return nr, err
+	}
+}
+
+// Close closes the file being read, if any.
+func (r *fileReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
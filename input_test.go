@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFileTrigger(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.log", "b.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		flags []string
+		files []string
+		want  string
+	}{
+		{nil, []string{"a.log"}, "a"},
+		{nil, []string{"a.log", "b.log"}, "a b"},
+
+		// The input line filters do not apply to the paths.
+		{[]string{"-since", "2h"}, []string{"a.log"}, "a"},
+		{[]string{"-valid-utf8-only"}, []string{"a.log"}, "a"},
+	}
+	for _, tc := range tests {
+		args := append(tc.flags, "-file-trigger", `(\w+)\.log$ echo $1`)
+		for _, f := range tc.files {
+			args = append(args, "-in", filepath.Join(dir, f))
+		}
+		_, stderr, code := runTea(t, "", append(args, "nomatch", "true")...)
+		if code != 0 {
+			t.Errorf("Flags %q, files %q: exit status %d, stderr:\n%s", tc.flags, tc.files, code, stderr)
+			continue
+		}
+		got := strings.Fields(stderr)
+		slices.Sort(got)
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("Flags %q, files %q: file triggers fired for %q, want %q", tc.flags, tc.files, got, tc.want)
+		}
+	}
+}
+
+func TestFileTriggerCSV(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "a.log"), filepath.Join(dir, "out.csv")
+	if err := os.WriteFile(in, []byte("k=v\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code := runTea(t, "", "-csv", out, "-in", in,
+		"-file-trigger", `(\w+)\.log$ true`, `(?P<key>\w+)=`, "true")
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	slices.Sort(got[1:]) // the order of rows depends on when the triggers fire
+	want := []string{"trigger,match,key,1", "1,k=,k,", "2,a.log,,a"}
+	if !slices.Equal(got, want) {
+		t.Errorf("CSV output:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestFileTriggerGNUFormat(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "a.log"), filepath.Join(dir, "out.txt")
+	if err := os.WriteFile(in, []byte("x\nk=v\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code := runTea(t, "", "-gnu-format", out, "-in", in,
+		"-file-trigger", `(\w+)\.log$ true`, `\w+=`)
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file trigger writes no location, and does not count the path as a
+	// line of the file.
+	if got, want := string(data), in+":2:1: k=\n"; got != want {
+		t.Errorf("GNU format output: got %q, want %q", got, want)
+	}
+}
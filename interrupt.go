@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	interruptOnce sync.Once
+	interruptMu   sync.Mutex
+	interruptFns  []func() // called when the program is interrupted
+)
+
+// atInterrupt registers f to be called if the program is stopped by SIGINT or
+// SIGTERM, before it exits, so that buffered output is not lost. The functions
+// are called in order of registration.
+func atInterrupt(f func()) {
+	interruptOnce.Do(handleInterrupts)
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+	interruptFns = append(interruptFns, f)
+}
+
+// handleInterrupts starts a goroutine that calls the atInterrupt functions on
+// receipt of SIGINT or SIGTERM, then restores the default behavior of the
+// signal and delivers it again.
+func handleInterrupts() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		interruptMu.Lock()
+		for _, f := range interruptFns {
+			f()
+		}
+		interruptMu.Unlock()
+		signal.Reset(s)
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(s) == nil {
+			return
+		}
+		os.Exit(1)
+	}()
+}
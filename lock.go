@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// A fileLock is an advisory lock on a file, held while running a command with
+// -lockfile, to serialize commands across processes. The lock is also held
+// exclusively within the process, since the file lock is shared by all the
+// holders of the same open file.
+type fileLock struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openFileLock opens or creates the lock file at path.
+func openFileLock(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// lock blocks until the caller holds the lock.
+func (l *fileLock) lock() error {
+	l.mu.Lock()
+	if err := lockFile(l.f); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// unlock releases the lock held by the caller.
+func (l *fileLock) unlock() error {
+	defer l.mu.Unlock()
+	return unlockFile(l.f)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// File locking is not supported on this platform.
+func lockFile(f *os.File) error {
+	return errors.New("file locking is not supported on this platform")
+}
+
+func unlockFile(f *os.File) error { return nil }
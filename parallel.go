@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// A parallelWriter is an io.Writer that writes each block of data to several
+// writers concurrently, using a fixed pool of workers, for -trigger-workers.
+// Each write waits until all the writers have finished with the block, so
+// each writer still sees the data in order.
+type parallelWriter struct {
+	ws   []io.Writer
+	jobs chan parallelJob
+}
+
+type parallelJob struct {
+	w    io.Writer
+	data []byte
+	err  *error
+	wg   *sync.WaitGroup
+}
+
+// newParallelWriter constructs a parallelWriter for ws that runs n workers.
+func newParallelWriter(ws []io.Writer, n int) *parallelWriter {
+	p := &parallelWriter{ws: ws, jobs: make(chan parallelJob)}
+	for range n {
+		go func() {
+			for job := range p.jobs {
+				_, *job.err = job.w.Write(job.data)
+				job.wg.Done()
+			}
+		}()
+	}
+	return p
+}
+
+// Write implements the io.Writer interface. It reports the first error from
+// any of the writers, in order.
+func (p *parallelWriter) Write(data []byte) (int, error) {
+	errs := make([]error, len(p.ws))
+	var wg sync.WaitGroup
+	wg.Add(len(p.ws))
+	for i, w := range p.ws {
+		p.jobs <- parallelJob{w: w, data: data, err: &errs[i], wg: &wg}
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+func BenchmarkTriggerWorkers(b *testing.B) {
+	const ntrig = 64
+	input := benchInput(10000, 100)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Workers=%d", workers), func(b *testing.B) {
+			var rules [][]string
+			for i := range ntrig {
+				rules = append(rules, []string{fmt.Sprintf(`latency=%d\d*ms path=/api/none`, i), "true"})
+			}
+			var ws []io.Writer
+			for _, t := range parseTriggers(b, rules...) {
+				ws = append(ws, t)
+			}
+			w := io.MultiWriter(ws...)
+			if workers > 1 {
+				w = newParallelWriter(ws, workers)
+			}
+			b.SetBytes(int64(len(input)))
+			b.ResetTimer()
+			for range b.N {
+				writeBlocks(b, w, input)
+			}
+		})
+	}
+}
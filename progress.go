@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progressMode is the value of the -progress flag. As a boolean flag, -progress
+// alone means "auto".
+type progressMode string
+
+func (p *progressMode) String() string   { return string(*p) }
+func (p *progressMode) IsBoolFlag() bool { return true }
+
+func (p *progressMode) Set(s string) error {
+	switch s {
+	case "true", "auto":
+		*p = "auto"
+	case "false", "never", "":
+		*p = ""
+	case "always":
+		*p = "always"
+	default:
+		return fmt.Errorf("invalid progress mode %q (want auto, always, or never)", s)
+	}
+	return nil
+}
+
+// enabled reports whether progress should be reported to stderr.
+func (p progressMode) enabled() bool {
+	switch p {
+	case "always":
+		return true
+	case "auto":
+		fi, err := os.Stderr.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0
+	}
+	return false
+}
+
+// nmatches counts the matches found by all triggers, for -progress.
+var nmatches atomic.Int64
+
+// A progressReader is an io.Reader that counts the bytes read from an
+// underlying reader, and periodically reports them to stderr.
+type progressReader struct {
+	r     io.Reader
+	nread atomic.Int64
+	done  chan struct{}
+	quit  chan struct{}
+}
+
+// newProgressReader returns a progressReader for r that reports its progress
+// every interval until it is stopped.
+func newProgressReader(r io.Reader, interval time.Duration) *progressReader {
+	p := &progressReader{r: r, done: make(chan struct{}), quit: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-p.quit:
+				p.report("\n")
+				return
+			case <-tick.C:
+				p.report("")
+			}
+		}
+	}()
+	return p
+}
+
+// Read implements the io.Reader interface.
+func (p *progressReader) Read(data []byte) (int, error) {
+	nr, err := p.r.Read(data)
+	p.nread.Add(int64(nr))
+	return nr, err
+}
+
+// report rewrites the status line on stderr, followed by end.
+func (p *progressReader) report(end string) {
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%d bytes read, %d matches%s", p.nread.Load(), nmatches.Load(), end)
+}
+
+// Stop stops reporting progress, after writing a final status line.
+func (p *progressReader) Stop() {
+	close(p.quit)
+	<-p.done
+}
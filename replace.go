@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket.org/creachadair/shell"
+)
+
+// A rewriter is an io.Writer that applies the substitutions of -replace
+// triggers to each line of its input before writing it to an underlying
+// writer. An incomplete line is held back until its newline arrives, or until
+// the rewriter is flushed.
+type rewriter struct {
+	w       io.Writer
+	trigs   []*trigger // the triggers with substitutions, in order
+	partial []byte
+}
+
+// Write implements the io.Writer interface.
+func (r *rewriter) Write(data []byte) (int, error) {
+	r.partial = append(r.partial, data...)
+	var out []byte
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+		out = append(out, r.rewrite(r.partial[:i])...)
+		out = append(out, '\n')
+		r.partial = r.partial[i+1:]
+	}
+	if len(out) != 0 {
+		if _, err := r.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush rewrites and writes any incomplete final line.
+func (r *rewriter) Flush() error {
+	if len(r.partial) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(r.rewrite(r.partial))
+	r.partial = nil
+	return err
+}
+
+// rewrite applies the substitution of each trigger to line, in order.
+func (r *rewriter) rewrite(line []byte) []byte {
+	for _, t := range r.trigs {
+		line = t.replaceAll(line)
+	}
+	return line
+}
+
+// replaceAll returns a copy of line in which each match of the trigger's
+// pattern is replaced by the expansion of its -replace template. If there are
+// no matches, line is returned unmodified.
+func (t *trigger) replaceAll(line []byte) []byte {
+	ms := t.findAll(line, 0)
+	if len(ms) == 0 {
+		return line
+	}
+	var out []byte
+	last, text, now := 0, string(line), time.Now()
+	for _, m := range ms {
+		out = append(out, line[last:m[0]]...)
+		x := &match{m: m, text: text, when: now, count: 1, source: inputName()}
+		if t.replaceCmd {
+			out = append(out, t.replacement(x)...)
+		} else if t.replMap != nil {
+			out = append(out, t.lookup(x)...)
+		} else {
+			out = append(out, t.expand(t.replace, x)...)
+		}
+		last = m[1]
+	}
+	return append(out, line[last:]...)
+}
+
+// lookup returns the -replace-map entry for the match x, keyed by its first
+// submatch (or the whole match if there are none). If there is no entry, it
+// returns the expansion of the -replace template if there is one, or else the
+// matched text unchanged.
+func (t *trigger) lookup(x *match) string {
+	key := "0"
+	if t.re.NumSubexp() > 0 {
+		key = "1"
+	}
+	if val, ok := t.replMap[t.submatch(key, x.text, x.m)]; ok {
+		return val
+	} else if t.replace != "" || t.replFallback {
+		return t.expand(t.replace, x)
+	}
+	return x.text[x.m[0]:x.m[1]]
+}
+
+// loadReplaceMap reads a -replace-map file. Each non-blank line of the file
+// gives a key and its replacement, separated by a tab.
+func loadReplaceMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing tab between key and replacement", i+1)
+		}
+		m[key] = val
+	}
+	return m, nil
+}
+
+// replacement runs the trigger's command for the match x, and returns its
+// output with any trailing newline removed, for -replace-cmd. If the command
+// fails, the matched text is returned unchanged.
+func (t *trigger) replacement(x *match) []byte {
+	orig := []byte(x.text[x.m[0]:x.m[1]])
+	if t.disabled.Load() {
+		return orig
+	}
+	var args []string
+	for _, arg := range t.args {
+		args = append(args, t.expand(arg, x))
+	}
+	diag("Running command for replacement: %s %s", t.cmd, shell.Join(args))
+	proc := t.command(args)
+	proc.Env = t.environ(x)
+	proc.Stderr = cmdErrors
+	if t.isPipe {
+		proc.Stdin = t.pipeInput(strings.NewReader(t.pipeText(x)))
+	}
+	var out bytes.Buffer
+	proc.Stdout = &out
+	err := t.runProc(proc)
+	if isMissing(err) {
+		t.disable(err)
+		return orig
+	} else if err != nil {
+		t.logFailure(err)
+		t.failed(err)
+		return orig
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
+
+// An inPlaceEdit manages a file being edited in place, for -inplace.  The
+// edited output is written to a temporary file in the same directory, which
+// replaces the original only if the edit completes successfully.
+type inPlaceEdit struct {
+	path string
+	in   *os.File // the original file
+	tmp  *os.File // the edited output
+}
+
+// beginInPlace opens the file at path for editing in place.
+func beginInPlace(path string) (*inPlaceEdit, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := in.Stat()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tea*")
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		in.Close()
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &inPlaceEdit{path: path, in: in, tmp: tmp}, nil
+}
+
+// finish completes the edit. If commit is true, the edited output replaces the
+// original file; otherwise the output is discarded and the original is left
+// unchanged.
+func (e *inPlaceEdit) finish(commit bool) error {
+	e.in.Close()
+	err := e.tmp.Close()
+	if !commit || err != nil {
+		os.Remove(e.tmp.Name())
+		return err
+	}
+	return os.Rename(e.tmp.Name(), e.path)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Muting triggers by signal is not supported on this platform.
+var muteSignal, unmuteSignal os.Signal
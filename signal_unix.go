@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// The signals that mute and unmute -mutable triggers.
+var muteSignal, unmuteSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
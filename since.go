@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// sinceFilter is the lineFilter for -since, or nil if it is not set.
+var sinceFilter lineFilter
+
+// newSinceFilter returns a lineFilter that keeps only lines whose timestamp
+// is not before since. The timestamp is the first submatch of pattern in the
+// line (or the whole match, if it has no submatches), parsed with the given
+// time layout. Since may be a time in the same layout, a time in RFC 3339
+// format, or a duration before the current time. Lines without a valid
+// timestamp are kept if keepBad is true, and discarded otherwise.
+func newSinceFilter(since, layout, pattern string, keepBad bool) (lineFilter, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -ts-pattern: %w", err)
+	}
+	var min time.Time
+	if d, err := time.ParseDuration(since); err == nil {
+		min = time.Now().Add(-d)
+	} else if min, err = time.Parse(layout, since); err != nil {
+		if min, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, fmt.Errorf("invalid -since %q: not a duration or a time in -ts-format", since)
+		}
+	}
+	return func(line []byte) ([]byte, bool) {
+		m := re.FindSubmatch(line)
+		if m == nil {
+			return line, keepBad
+		}
+		ts := m[0]
+		if len(m) > 1 {
+			ts = m[1]
+		}
+		when, err := time.Parse(layout, string(ts))
+		if err != nil {
+			diag("Invalid timestamp %q: %v", ts, err)
+			return line, keepBad
+		}
+		return line, !when.Before(min)
+	}, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// sorted holds firings deferred by -sort-output.
+var sorted sortQueue
+
+// A sortQueue holds firings of triggers until the end of the input, so that
+// they can be fired in order of their positions.
+type sortQueue struct {
+	mu       sync.Mutex
+	firings  []firing
+	released bool
+}
+
+// A firing is a deferred firing of a trigger.
+type firing struct {
+	t  *trigger
+	at int64 // the input offset of the match
+	x  *match
+}
+
+// hold reports whether the firing of t for the match x should be deferred, and
+// if so saves it. The caller must hold t.mu.
+func (q *sortQueue) hold(t *trigger, x *match) bool {
+	if !*sortOutput {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.released {
+		return false
+	}
+	q.firings = append(q.firings, firing{t: t, at: t.matchAt, x: x})
+	return true
+}
+
+// release fires all the deferred firings in order of position, and thereafter
+// allows firings to proceed immediately.
+func (q *sortQueue) release() {
+	q.mu.Lock()
+	fs := q.firings
+	q.firings, q.released = nil, true
+	q.mu.Unlock()
+
+	sort.SliceStable(fs, func(i, j int) bool {
+		if fs[i].at != fs[j].at {
+			return fs[i].at < fs[j].at
+		}
+		return fs[i].t.id < fs[j].t.id
+	})
+	for _, f := range fs {
+		t := f.t
+		t.mu.Lock()
+		if *maxFires <= 0 || t.nfired < *maxFires {
+			t.launchMatch(f.x)
+		}
+		t.mu.Unlock()
+	}
+}
@@ -7,33 +7,165 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math/rand/v2"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"regexp/syntax"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"bitbucket.org/creachadair/shell"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
 var (
-	bufLimit   = flag.Int("buf", 1<<16, "Match buffer size limit in bytes")
-	doVerbose  = flag.Bool("v", false, "Verbose logging")
-	cmdOutFile = flag.String("cout", "", "Write command output to this file")
+	bufLimit    = flag.Int("buf", 1<<16, "Match buffer size limit in bytes")
+	bufOverlap  = flag.Int("buf-overlap", 0, "When trimming the buffer, keep up to this many more bytes to start at a line")
+	doVerbose   = flag.Bool("v", false, "Verbose logging")
+	cmdOutFile  = flag.String("cout", "", "Write command output to this file (may include submatches)")
+	cmdErrFile  = flag.String("cerr", "", "Write command error output to this file")
+	mergeOut    = flag.Bool("merge-cmd-output", false, "Write command output and error output to standard output")
+	errToOut    = flag.Bool("cerr-cout", false, "Write command error output to the same place as -cout")
+	extractFile = flag.String("extract", "", "Write the submatches of each match as JSON to this file")
+	print0      = flag.Bool("print0", false, "End each -extract, -gnu-format, and -template record with NUL instead of newline")
+	exitFile    = flag.String("exit-log", "", "Append the exit status of each command to this file")
+	tmplText    = flag.String("template", "", "Write a record for each match to -template-out, formatted by this Go template")
+	tmplFile    = flag.String("template-out", "", "Write the -template records to this file")
+	csvPath     = flag.String("csv", "", "Write the submatches of each match as a CSV row to this file")
+	gnuFile     = flag.String("gnu-format", "", "Write the location of each match as file:line:col: text to this file")
+	jitter      = flag.Duration("jitter", 0, "Delay each firing by a random duration up to this long")
+	execUmask   = flag.String("exec-umask", "", "Run commands with this umask (in octal)")
+	execUser    = flag.String("exec-user", "", "Run commands as this user (requires privilege)")
+	cmdStdin    = flag.String("cmd-stdin", "", "Connect the standard input of each non-pipe command to this file")
+	coutMax     = flag.Int64("cout-max-size", 0, "Stop writing to each -cout file once it has this many bytes (0 means unlimited)")
+	maxOpenOut  = flag.Int("cout-max-open", 64, "Maximum number of templated -cout files to keep open")
+	inEncoding  = flag.String("encoding", "utf-8", "Character encoding of the input")
+	crlf        = flag.Bool("crlf", false, "Convert CRLF line endings to LF before matching")
+	since       = flag.String("since", "", "Match only lines with a timestamp at or after this time (or this long ago)")
+	tsFormat    = flag.String("ts-format", time.RFC3339, "The Go time layout of -since timestamps")
+	tsPattern   = flag.String("ts-pattern", `^\S+`, "A regexp locating the -since timestamp in each line (by its first submatch, if any)")
+	tsKeepBad   = flag.Bool("ts-keep-invalid", false, "With -since, match lines without a valid timestamp")
+	validUTF8   = flag.Bool("valid-utf8-only", false, "Do not match input lines that are not valid UTF-8")
+	decodeOut   = flag.Bool("decode-output", false, "Write decoded UTF-8 to stdout instead of raw input")
+	maxFires    = flag.Int("max-fires", 0, "Fire each trigger at most this many times (0 means unlimited)")
+	keepEvery   = flag.Duration("keepalive-interval", 0, "Write -keepalive-text to stdout after this long without input (0 means never)")
+	keepText    = flag.String("keepalive-text", "", "The line to write to stdout for -keepalive-interval")
+	idleExit    = flag.Duration("idle-exit", 0, "Exit if no input arrives for this long (0 means never)")
+	maxExit     = flag.Bool("max-fires-exit", false, "Exit once all triggers have reached -max-fires")
+	maxLines    = flag.Int("multi-max-lines", 0, "Limit multi-line matches to this many lines (0 means no limit)")
+	winMatch    = flag.Bool("window-match", false, "In multi-line mode, do not rescan input older than -window-overlap")
+	winOverlap  = flag.Int("window-overlap", 4096, "Window overlap in bytes for -window-match")
+	strictRefs  = flag.Bool("strict-refs", false, "Fail at startup if a trigger refers to a submatch its pattern does not define")
+	lockPath    = flag.String("lockfile", "", "Hold an exclusive lock on this file while running each command")
+	interp      = flag.String("interp", "", "Run each trigger command as an argument to this interpreter")
+	strictCmd   = flag.Bool("strict-cmd", false, "Fail at startup if a trigger command cannot be found")
+	lineWait    = flag.Duration("line-timeout", 0, "Match an incomplete line after this long without input (0 means never)")
+	paragraph   = flag.Bool("paragraph", false, "In line mode, match records separated by blank lines instead of lines")
+	posixRE     = flag.Bool("posix", false, "Use POSIX (egrep) syntax and leftmost-longest matching for all patterns")
+	matchLimit  = flag.Int("match-limit", 1, "Fire for at most this many matches per line (0 means unlimited)")
+	workers     = flag.Int("trigger-workers", 0, "Offer input to triggers concurrently with this many workers (0 means one at a time)")
+	sharedBuf   = flag.Bool("shared-buf", false, "Share a single input buffer among all triggers")
+	inPlace     = flag.String("inplace", "", "Read this file as input and replace it with the output")
+	watchPath   = flag.String("watch", "", "Read lines appended to the files in this directory instead of stdin")
+	watchEvery  = flag.Duration("watch-interval", time.Second, "Poll the -watch directory at this interval")
+	tailLines   = flag.Int("tail-lines", 0, "Start reading at the last this many lines of a seekable input")
+	closeWait   = flag.Duration("close-timeout", 0, "At exit, wait at most this long for commands to finish (0 means forever)")
+	closeKill   = flag.Bool("close-kill", false, "Kill commands still running after -close-timeout")
+	maxLineLen  = flag.Int("max-line-length", 0, "In line mode, split lines longer than this many bytes (0 means unlimited)")
+	maxMemory   = flag.Int64("max-memory", 0, "Stop with an error if triggers buffer more than this many bytes (0 means unlimited)")
+	ensureNL    = flag.Bool("ensure-newline", false, "End the output with a newline, adding one if the input lacks it")
+	outBuf      = flag.Int("output-buffer", 0, "Buffer up to this many bytes of standard output (0 means unbuffered)")
+	outFlush    = flag.Duration("output-flush", time.Second, "Flush buffered standard output at this interval")
+	hookWait    = flag.Duration("webhook-timeout", 10*time.Second, "Timeout for -webhook requests")
+	syncFire    = flag.Bool("sync-fire", false, "Run each command to completion before reading more input")
+	serial      = flag.Bool("serial", false, "Run commands for all triggers one at a time, in order of matching")
+	errorEvery  = flag.Duration("error-every", 0, "Log command failures for each trigger at most once per this interval (0 means always)")
+	failFast    = flag.Bool("fail-fast", false, "Stop and exit with its status when a command first fails")
+	progEvery   = flag.Duration("progress-every", time.Second, "Update the -progress status at this interval")
+	maxCmdOut   = flag.Int64("max-cmd-output", 0, "Truncate the output of each command to this many bytes (0 means unlimited)")
+	sortOutput  = flag.Bool("sort-output", false, "Fire all triggers at the end of input, in order of match position")
+	listCaps    = flag.Bool("list-captures", false, "List the submatches defined by each trigger and exit without reading input")
+	beforeCmd   = flag.String("before", "", "A command line to run before reading input, which must succeed")
+	beforeRetry = flag.Int("before-retry", 0, "Retry a failing -before command up to this many times")
+	beforeWait  = flag.Duration("before-retry-interval", time.Second, "Wait this long between -before retries")
+	beatEvery   = flag.Duration("every-interval", 0, "Run the -every-cmd command at this interval (0 means never)")
+	beatCmd     = flag.String("every-cmd", "", "A command line to run every -every-interval, independent of the triggers")
+	doCheck     = flag.Bool("check", false, "Check that all triggers are valid and exit without reading input")
+	muteFile    = flag.String("mute-file", "", "On a mute or unmute signal, read the numbers of the -mutable triggers to affect from this file")
 
-	cmdOutput = os.Stderr
+	cmdOutput  io.Writer       = os.Stderr
+	extractOut *recordFile     // if not nil, write -extract records here
+	gnuOut     *recordFile     // if not nil, write -gnu-format locations here
+	csvOut     *csvFile        // if not nil, write -csv rows here
+	tmplOut    *templateOutput // if not nil, write -template records here
+	cmdLock    *fileLock       // if not nil, hold this lock while running commands
+	exitLog    *recordFile     // if not nil, write -exit-log records here
+	cmdErrors  = os.Stderr
+	stdout     *outputWriter // the standard output, set up by run
+	outFiles   *outputCache  // if not nil, -cout is a template
+
+	// stopped is closed when input processing should end before EOF.
+	stopped  = make(chan struct{})
+	stopOnce sync.Once
+
+	// closeDeadline reports when -close-timeout expires. The deadline is fixed
+	// when the first trigger closes, so that the timeout bounds the shutdown as
+	// a whole rather than each trigger in turn.
+	closeDeadline = sync.OnceValue(func() time.Time { return time.Now().Add(*closeWait) })
+
+	// serialQueue, if not nil, receives firings to be run one at a time.
+	serialQueue chan func()
+
+	procAttr *syscall.SysProcAttr // if not nil, attributes for commands (-exec-user)
+
+	nseq       atomic.Int64 // the number of firings so far, for $SEQ
+	exitStatus atomic.Int32 // the exit status of the program
+	failStatus atomic.Int32 // the highest -fail-exit code of a failed trigger
+	buffered   atomic.Int64 // total bytes of input buffered by triggers
 )
 
+// errStopped is reported by writes to the input pipeline after stopped is
+// closed.
+var errStopped = errors.New("input processing stopped")
+
+// stopInput requests that input processing end early, logging why.
+func stopInput(why string) {
+	stopOnce.Do(func() {
+		diag("Stopping input: %s", why)
+		close(stopped)
+	})
+}
+
+// progress is the value of the -progress flag.
+var progress progressMode
+
 func init() {
+	flag.Var(&progress, "progress", "Report progress to stderr (auto, always, or never)")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, `Usage: %s [options] [regexp command args...]
+		fmt.Fprintf(os.Stderr, `Usage: %s [options] [[trigger-options] regexp command args...]
 
 Copy standard input to standard output. If a trigger consisting of a regexp
 and command are given, each match of the regexp in the input triggers an
@@ -41,15 +173,203 @@ execution of the given command and arguments.
 
 Trigger commands are run in parallel with input processing, but only one
 command for a given trigger will run at a time; a subsequent invocation will
-block until the prior invocation is complete. Output from a trigger command
-is redirected to stderr unless -cout is set.
+block until the prior invocation is complete. The -on-busy trigger option
+controls what happens to a match that arrives while the command is running:
+"block" (the default) stops input processing until the command finishes,
+"queue" saves the match to fire later without blocking, and "drop" discards
+the match and logs it.
+
+With -sort-output, triggers do not fire as matches are found. Instead, all
+matches of all triggers are saved until the end of the input, and then fired
+(and written to -extract) in order of their positions in the input, with ties
+broken by the order of the triggers. This makes the order of firing and of
+-extract records deterministic, but the matches are held in memory. Positions
+are approximate with -since or -valid-utf8-only, or for triggers with -decode.
+Commands for different triggers may still overlap unless -serial is also set.
+
+Each block of input is normally offered to the triggers one at a time. With
+many triggers, set -trigger-workers to the number of triggers to offer each
+block to concurrently; each trigger still sees the whole input in order, but
+firings of different triggers for the same block occur in no particular order.
+
+With -sync-fire, each command runs to completion as part of processing the
+input that matched it, before any more input is read. This gives strict
+backpressure: commands of all triggers run one at a time, in the order their
+matches occur in the input (for each block of input, in trigger order), and
+the input is read no faster than the commands can keep up. The cost is that
+commands never run in parallel with each other or with input processing.
+Only the default -on-busy policy can be used with -sync-fire.
+
+With -jitter d, each firing is delayed by a random duration up to d before its
+command runs, to spread out the load when many matches arrive together. The
+delay counts as part of the firing, so it does not reorder the commands of a
+trigger, and the trigger remains busy while it waits.
+
+With -serial, only one command runs at a time across all triggers, in the
+order they were dispatched. Since each block of input is offered to the
+triggers in turn, matches of different triggers within a block may not run in
+input order. This ensures that commands do not overlap, but may delay both
+the commands and input processing considerably.
+
+Output from a trigger command is redirected to stderr unless -cout is set, in
+which case it is appended to the named file. Error output from a command goes
+to stderr, unless -cerr names a file to append it to, or -cerr-cout is set to
+send it to the same place as the standard output. With -merge-cmd-output, both
+the output and error output of commands are written to standard output, so
+that they flow downstream with the input. They are interleaved with the input
+as they are written, and commands for different triggers may overlap unless
+-serial is set. This cannot be used with -inplace, so that command output is
+not written into the file.
+
+Multiple triggers may be provided, separated by "--". Each trigger may begin
+with options that apply only to that trigger, listed below under "Trigger
+options". Options for the first trigger must be preceded by "--" to separate
+them from the global options. The options end at the first word that is not a
+trigger option, so a pattern may begin with "-" unless it looks like a trigger
+option; to use such a pattern, escape it as "\-". Use -check to verify that
+the triggers are valid without reading any input, or -list-captures to list
+the submatches each trigger's pattern defines (including those of
+-file-trigger), for use in command arguments.
 
-Multiple triggers may be provided, separated by "--".
+A trigger with -ignore-case-ascii matches ASCII letters without regard to
+case, by converting upper-case ASCII letters to lower case in both the pattern
+and the input before matching. This is faster than (?i), which folds case for
+all of Unicode, but non-ASCII letters still match only in the case written.
+The text given to commands is not converted.
+
+A trigger with -distinct name fires only the first time each distinct value
+of the named (or numbered) submatch is seen. Each value is remembered for the
+rest of the input, so memory use grows with the number of distinct values;
+use -distinct-max to limit this, at the cost of forgetting (and re-firing for)
+the oldest values. With -distinct-fold, values that differ only in case are
+treated as the same, though commands still see the text as it was matched.
+
+A trigger with -num-gt name=value fires only for matches in which the named
+(or numbered) submatch is a number greater than value, and similarly for
+-num-lt with less than; with both, a match must satisfy each, e.g., -num-gt
+ms=1000 for a submatch "ms" of a latency. The numbers may be integers or
+decimal fractions, and are compared as floating-point values. A match whose
+submatch is not a number does not fire (this is logged with -v).
+
+A trigger with -count-by name counts its matches by the value of the named (or
+numbered) submatch, and prints the counts to stderr at exit, most frequent
+first. With -count-max n, at most n values are counted separately, and the
+matches for any others are counted together as "(other)". A trigger with
+-count-by need not have a command.
+
+A trigger with -decode matches against the decoded content of each input
+line, which must be entirely in the given encoding (base64 or hex), ignoring
+surrounding whitespace. Lines that cannot be decoded are not matched. The
+passthrough to stdout is not affected, but the match text given to commands
+is decoded.
+
+For input with timestamped lines, such as logs, -since t matches only lines
+whose timestamp is at or after t; older lines are still copied to the output.
+The timestamp is found by -ts-pattern, a regexp whose first submatch (or whole
+match) is the timestamp, by default the first word of the line, and parsed as
+a Go time layout given by -ts-format (RFC 3339 by default). The time t may be
+given in that layout, in RFC 3339 format, or as a duration before the start
+of the program, e.g., -since 2h. Lines without a valid timestamp are not
+matched, unless -ts-keep-invalid is set. A timestamp without a time zone is
+taken to be in UTC.
+
+If -max-fires is set, each trigger fires at most that many times; later
+matches are ignored. With -max-fires-exit, once every trigger has reached its
+limit, input processing stops and the program exits after in-flight commands
+have finished.
+
+With -idle-exit d, if no input arrives for d, input processing stops and the
+program exits (with status 0) after in-flight commands have finished, as at
+the end of the input. This keeps a stalled pipe from running forever.
+
+With -keepalive-interval d, a line is written to standard output whenever d
+passes without input, for consumers downstream that give up on a quiet pipe.
+The line is the -keepalive-text (empty, by default) followed by a newline. It
+is written only between lines of the output, and is not seen by the triggers.
+
+The -buf limit applies only to multi-line triggers. In line mode, a trigger
+buffers each line until its newline arrives, so input without newlines may be
+buffered without limit. With -max-line-length n, a line longer than n bytes is
+split, and each piece of n bytes is matched as if it were a complete line (or
+-paragraph record), so a match that spans a split is not found. To protect against
+unbounded memory use in general, -max-memory sets a limit on the total input
+buffered by all triggers together; if it is exceeded, the program stops
+reading input and exits with an error once commands have finished.
+
+With -fail-fast, the first command that fails causes the program to stop
+reading input and exit with the status of that command (or 1, if it has no
+status) once commands have finished. Commands already running or waiting to
+run may still do so.
+
+By default, a failing command does not affect the exit status of the program.
+A trigger with -fail-exit n sets the exit status to at least n if any of its
+commands (or webhook requests) fail, while input processing continues. When
+several such triggers fail, or the program would otherwise exit with an error,
+the highest status wins.
+
+At the end of input, each trigger waits for its commands to finish. Set
+-close-timeout to bound this wait; commands still running after the timeout
+are abandoned, or killed if -close-kill is set. The timeout applies to all the
+triggers together, starting at the end of input.
+
+By default, matches are applied line-by-line, as in grep, and each line fires
+for at most one match. Set -match-limit to fire for more non-overlapping
+matches on the same line (0 means no limit). The last line of input is
+matched at the end of input even if it does not end with a newline. To match
+an incomplete line sooner, for example a prompt, set -line-timeout; a partial
+line that receives no more input for that long is matched as if complete.
 
-By default, matches are applied line-by-line, as in grep.
 If a pattern sets the multi-line flag (?m), matches for that trigger may
 span multiple lines, over a buffer of up to -buf bytes.
 
+Patterns use the syntax of Go's regexp package (like Perl's), and prefer
+the leftmost match that a backtracking engine would find first. With -posix,
+all patterns use POSIX extended (egrep) syntax instead, and each match is the
+leftmost-longest one: for example, "a|ab" matches all of "ab", where by
+default it matches only "a". POSIX syntax has no flags, so Perl classes like
+\d and (?m) are not available, and all triggers use line mode.
+
+An -anchored trigger matches only at the start of its buffer, that is, just
+after the end of the previous match (or at the start of a line, in line mode).
+In multi-line mode, if the buffer exceeds -buf bytes without a match, the
+oldest data are discarded, and subsequent matches are anchored to wherever
+the buffer then begins.
+
+Each trigger normally keeps its own copy of the input it has not yet matched.
+With -shared-buf, all triggers share a single buffer, which uses less memory
+when there are many triggers.
+
+After a multi-line match, the input up to the end of the match is consumed,
+including any input before the match that did not match. With the trigger
+option -keep-prefix, only the match itself is removed, and the input before
+it is kept to be matched again with the input that follows. This may find
+matches that would otherwise be missed, but keeps more input in the buffer
+(up to -buf), and the input is searched again for each later match.
+
+When the multi-line buffer exceeds -buf, the oldest input is discarded, which
+may cut off the start of a match that has not yet been seen in full. With
+-buf-overlap n, the cut is moved back to the start of its line, keeping up to
+n more bytes, so that a match beginning at the start of a line is not cut in
+the middle. This mitigates, but does not prevent, missed matches: a match
+longer than the buffer can still not be found.
+
+Setting -multi-max-lines limits multi-line matches to at most that many lines
+of input. A match is sought only within the first lines of the buffer; if
+there is none, the first line is discarded and the search moves ahead. This
+bounds the latency and cost of each search, but longer matches are missed.
+
+With -paragraph, line-mode patterns match records separated by blank lines
+instead of single lines, as for entries in a log. Each record includes the
+newlines between its lines, but not the blank lines that separate it from the
+next record. Since a record does not contain the newline that ends it, ^ and
+$ without (?m) match the start and end of the record.
+
+By default, each new block of input causes the whole multi-line buffer to be
+scanned again. With -window-match, a failed scan advances a cursor so that
+later scans begin at most -window-overlap bytes before the end of the buffer
+(aligned to the start of a line where possible). This is much faster for large
+buffers, but a match longer than the overlap may be missed.
+
 Pattern syntax is as defined by: https://pkg.go.dev/regexp/syntax
 Submatches are interpolated into command arguments:
 
@@ -60,226 +380,3338 @@ Submatches are interpolated into command arguments:
 If the regular expression uses named capture groups like $(?P<name>...),
 the argument may also use the syntax ${name}.
 
+To pass a literal "$" to a command, write "$$"; this is never treated as the
+start of a reference, so "$$1" is the literal text "$1" and "$$$1" is a "$"
+followed by the first submatch. A reference without braces uses the longest
+possible name, so "$1x" refers to a submatch named "1x" (which is empty); write
+"${1}x" instead. A "$" that does not begin a valid reference, such as one at
+the end of an argument or before a space, is passed through unchanged.
+
+A reference in braces may include a directive that transforms the value:
+
+  ${name:json}  -- the value encoded as a JSON string, with quotes
+  ${name:line}  -- the line of the match on which the submatch begins, from 1,
+                   e.g., to locate a field in a multi-line match
+
+Arguments may also refer to special variables, which are distinguished by
+upper-case names. A capture group of the same name takes precedence.
+
+  $NOW           -- the time the trigger fired, in RFC 3339 format
+  ${NOW:layout}  -- the time the trigger fired, in a Go time layout
+  $PATTERN       -- the regular expression of the trigger
+  $COUNT         -- the number of matches the firing stands for (see -collapse)
+  $SEQ           -- the number of the firing among all triggers, from 1
+  $SOURCE        -- the name of the input file containing the match, or "-"
+  $LEN           -- the length of the match text, $0, in bytes
+
+Commands are run with the environment of the program, plus:
+
+  TEA_PATTERN    -- the regular expression of the trigger
+  TEA_COUNT      -- the value of $COUNT
+  TEA_SEQ        -- the value of $SEQ
+  TEA_SOURCE     -- the value of $SOURCE
+  TEA_MATCH_LEN  -- the value of $LEN
+
+The $SOURCE of a match is the input file (-in or -inplace) being read when
+the match was found. For input from stdin or -watch, it is "-".
+
 If the command name begins with a colon (":command") the match text
-is piped to the command's standard input.
+is piped to the command's standard input. The trigger options -pipe-prefix
+and -pipe-suffix give fixed text to pipe before and after it, for commands
+that expect some framing around their input. With -pipe-context n, up to n
+bytes of the input preceding the match text are piped before it, to give the
+command some context. This requires each trigger that uses it to keep a copy
+of the last n bytes of its input.
+
+If the command name begins with three colons (":::command"), the numbered
+submatches are piped to the command instead of the match text, each on a
+line of its own, in order of their index. A submatch that is empty or that did
+not participate in the match is piped as an empty line, so that line i is
+always submatch i. The pattern must have at least one submatch.
+
+With -flatten, each newline in the piped text is replaced by the -flatten-sep
+string (a space, by default), so that a multi-line match reaches the command
+as a single line. This also applies to the matches written to a -persist
+command. The text given in command arguments is not changed.
+
+When the program runs with privileges, e.g., to read protected logs, set
+-exec-user to run all commands as a less-privileged user, with that user's
+primary group. Set -exec-umask to run commands with the given umask (in
+octal), so that the files they create have predictable permissions; this is
+done by way of the shell, and does not affect the umask of the program itself.
+These options are not supported on all platforms.
+
+Commands that are not pipes normally have an empty standard input. Set
+-cmd-stdin to give each such command its own copy of the contents of a file;
+this cannot be combined with pipe commands.
+
+For a pipe command, the trigger option -pipe-file name pipes the contents of
+the file whose path is the value of the named submatch, instead of the match
+text. If the file cannot be read, an error is logged and the command is not
+run for that match.
+
+A trigger with -if 'command args...' runs the given command line, which is
+split into words as by a shell and may refer to submatches, before each firing.
+The trigger fires only if the predicate command succeeds. Both commands run in
+sequence with other firings of the trigger. The output of the predicate is
+discarded.
+
+With -extract, the submatches of each match are also written to the named
+file as a JSON object, one per line, keyed by the name of each submatch (or
+its index, if it is unnamed). In this mode a trigger may omit its command, so
+that matches are only extracted. Records are buffered, and buffered records are
+written at exit, including on receipt of an interrupt or termination signal.
+
+With -print0, each -extract, -gnu-format, and -template record ends with a
+NUL byte instead of a newline, for use with tools like "xargs -0". This is
+useful when the match text may contain whitespace or newlines.
+
+Similarly, -csv writes each match to the named file as a CSV row. The columns
+are the trigger number, the matched text, and the submatches of all triggers,
+by name or index, as given in the header row. A value is empty if its trigger
+has no such submatch, or if it did not participate in the match.
+
+For other formats, -template gives a Go text/template that is executed for
+each match, writing one record per match to the file named by -template-out.
+The template is executed with a value having these fields:
+
+  .Trigger  -- the number of the trigger
+  .Match    -- the text of the match ($0)
+  .Sub      -- the submatches, by name and by index, e.g., {{.Sub.host}}
+  .Source   -- the name of the input file ($SOURCE)
+  .Line     -- the line number of the match in .Source (the record number
+               with -paragraph), or 0 for a multi-line pattern
+  .Offset   -- the input offset of the match, in bytes
+  .Time     -- when the match was recorded, as a time.Time
+  .Seq      -- the number of the firing among all triggers ($SEQ)
+
+Each record ends with a newline (or NUL, with -print0). A trigger with
+-template need not have a command. The .Offset counts the input as the
+trigger sees it, after any conversion by -encoding or -crlf, and after the
+line filters of -since, -valid-utf8-only, and -decode. Input removed from the
+buffer by -keep-prefix is counted, so it does not change later offsets.
+
+As with -extract, the records for -csv, -gnu-format, and -template are
+buffered, and buffered records are written at exit, including on receipt of an
+interrupt or termination signal.
+
+A trigger with -webhook URL sends an HTTP request to the URL for each match,
+instead of running a command, and must not have a command. By default it posts
+the match text; set -webhook-body to a template that may refer to submatches,
+and -webhook-method and -webhook-type to change the request method and content
+type. The value of each named submatch is also sent in a header, e.g. the
+submatch "host" as X-Tea-Submatch-Host. Requests are sequenced like commands,
+and time out after -webhook-timeout. A response other than 2xx is an error.
+
+A trigger with -replace template replaces each match of its pattern in the
+output with the expansion of the template, which may refer to submatches, as
+sed does. Substitutions apply only to line-mode patterns, and are applied to
+each line of output by each such trigger in turn. The triggers still match the
+original input, and a trigger with -replace need not have a command.
+
+A trigger with -replace-cmd instead replaces each match with the output of its
+command, minus any trailing newline; if there is no output, the match is
+removed, and if the command fails, the match is left unchanged. Commands for
+substitutions run one at a time, in the order of their matches in the output,
+so that each replacement is placed correctly; this delays the output until
+each command is complete.
+
+A trigger with -replace-map file replaces each match with the entry for its
+first submatch (or the whole match, if there are none) in a table read from
+the file at startup. Each non-blank line of the file is a key and its
+replacement, separated by a tab. A match with no entry is left unchanged,
+unless -replace is also given, in which case its template is used instead.
+
+With -inplace file, the named file is read as input instead of stdin, and its
+contents are replaced by the output, as in sed -i. The output is written to a
+temporary file that replaces the original only if all the input was copied
+cleanly; otherwise the original is left unchanged.
+
+A trigger with -persist runs its command only once, at startup, as a filter.
+Each match is written to the standard input of the command as a line, and
+each line the command writes to its standard output is copied to standard
+output, interleaved with the input as it arrives. The command arguments may
+not refer to submatches, but "$$" may be used for a literal "$".
+
+A trigger with -collapse fires once for each run of consecutive matching
+lines, when the run ends at a non-matching line or the end of the input. The
+text of the firing, $0, is the lines of the run joined by newlines, and $COUNT
+is the number of lines. The text is piped to a command named ":command" as
+usual. Runs apply only to line-mode patterns.
+
+A trigger with -batch n saves its matches and fires once for each n of them,
+to amortize the cost of starting a command for frequent matches. The text of
+the firing, $0, is the matched text of the batch joined by newlines, and
+$COUNT is the number of matches; as usual, the text is piped to a command
+named ":command". A partial batch fires at the end of the input, or with
+-batch-timeout d, once d has passed since its first match. Other submatches
+cannot be referred to.
+
+A trigger with -gunzip-capture name decompresses the value of the named (or
+numbered) submatch, for compressed fields in the input. The value may be gzip
+data or gzip data encoded in base64. When the trigger fires, $0 and the text
+piped to a ":command" are the decompressed data; other submatches cannot be
+referred to. A match whose value cannot be decompressed is logged and skipped.
+
+A trigger with -fan-submatches runs its command once for each numbered
+submatch that is not empty, in order, with $0 referring to the submatch. The
+commands for a match run one after another, and all finish before the trigger
+fires again. Other submatches cannot be referred to.
+
+A trigger with -last does not fire as matches are found, but remembers the
+most recent match and fires once for it at the end of the input.
+
+Conversely, a trigger with -once fires for its first match only, e.g., to
+detect the first occurrence of an event. Later matches are ignored, but the
+input is still copied to the output as usual. With -collapse or -batch, the
+trigger fires once, for the first run or batch.
+
+A trigger with -mutable can be muted at runtime by sending the program
+SIGUSR1, and unmuted by sending SIGUSR2. A muted trigger continues to consume
+its input, but does not fire. By default, signals affect all -mutable
+triggers at once. With -mute-file path, each signal instead affects only the
+-mutable triggers whose numbers are listed in the named file, separated by
+spaces or newlines; triggers are numbered from 1 in the order given. The file
+is read when the signal arrives, so it may be rewritten before each signal.
+This is not supported on all platforms.
+
+Each failure of a trigger command is logged. With -error-every d, at most one
+failure is logged for each trigger in each interval d, and the number of other
+failures is reported with the next one that is logged, or at exit.
+
+If a trigger command cannot be found or executed, an error is logged once and
+the trigger is disabled for the rest of the input. With -strict-cmd, a command
+that cannot be found at startup is a fatal error instead.
+
+A trigger command of the form "@path" runs the script file at path, which need
+not be on the PATH, with the given arguments. It is checked at startup: the
+file must exist, and must be executable unless -interp is set, in which case
+it is run by the interpreter. Write ":@path" to pipe the match text to it.
+
+With -lockfile path, an exclusive advisory lock (flock) on the named file is
+held while each trigger command runs, so that commands run one at a time
+across all triggers and across separate processes using the same lock file.
+A firing waits until the lock is available, and the trigger is busy while it
+waits; a command that runs forever therefore blocks the others. The lock does
+not apply to -if, -persist, or -webhook. File locks are supported on Unix
+systems only.
+
+With -interp path, each trigger command is run as an argument to the given
+interpreter, as "path command args...", so that a script can be used as a
+command without making it executable or giving it a "#!" line. The -if and
+-every-cmd commands are run directly, as usual. With -interp, a missing
+trigger command is reported by the interpreter, and -strict-cmd does not
+apply.
+
+A reference to a submatch the pattern does not define expands to an empty
+string. With -strict-refs, such a reference in the arguments, -if command,
+-webhook-body, or -replace template of a trigger is a fatal error at startup
+instead, to catch mistakes in submatch names. Special variables are allowed.
+
+The -cout path may also refer to submatches, e.g., -cout 'out-${host}.log', in
+which case the output of each command is appended to the file named by
+expanding the path for its match. At most -cout-max-open such files are kept
+open at once; the least recently used are closed as needed. The values
+substituted into the path may not contain a path separator, nor make a
+component of the path "." or "..", so a match cannot name a file outside the
+directories given by the path; otherwise the command is not run.
+
+With -exit-log path, a record is appended to the named file each time a
+trigger command finishes, giving the time the trigger fired, the trigger
+number, the exit status of the command, and the command line, separated by
+tabs. The exit status is -1 if the command could not be run or was killed.
+Each record is written to the file as soon as its command finishes.
+
+With -before 'command args...', the command is run once before any input is
+read, and the program exits with an error if it fails. This may be used as a
+readiness check for a service the triggers depend on: with -before-retry n, a
+failing command is retried up to n more times, waiting -before-retry-interval
+between attempts, before giving up. Its output is handled as for trigger
+commands.
+
+With -every-interval d and -every-cmd 'command args...', the command is run
+every d while input is processed, independent of the triggers and of whether
+there are any matches, e.g., as a keepalive. Its output is handled as for
+trigger commands. A run still in progress when the next is due delays it, and
+at exit the program waits for a run in progress to finish.
+
+With -cout-max-size n, at most n bytes of command output are written to each
+-cout file, including any it held already, to protect the disk in long-running
+use. Once a file reaches the limit, a message is logged and later output for
+it is discarded; the commands are not affected.
+
+With -max-cmd-output n, at most n bytes of the output of each command are
+kept; the rest is discarded, and a marker is written to show that the output
+was truncated. With -cerr-cout, the limit includes the error output.
+
+With -ensure-newline, a newline is added at the end of the output if the last
+byte copied was not already a newline. By default, the input is copied exactly.
+
+Standard output is written as soon as input is read. For large inputs, set
+-output-buffer to buffer the output; buffered output is flushed every
+-output-flush, at exit, and on receipt of an interrupt or termination signal.
+
+With -in path, input is read from the named file instead of stdin. The flag
+may be repeated, and each path may be a glob pattern, expanded by tea itself
+in sorted order; a glob that matches no files is an error. The files are read
+in order, as if concatenated.
+
+With -watch dir, input is read from the files in the named directory instead
+of stdin, which is polled every -watch-interval, as by tail -F: lines appended
+to the files are copied and matched as they appear. Files present at startup
+are read from their ends, while new files, and files that replace one that was
+rotated, are read from the beginning. Files whose names begin with "." are
+ignored. Polling continues until the program is interrupted. Lines from
+different files are not mixed, but are interleaved in no particular order, so
+multi-line matches may span lines from different files.
+
+With -file-trigger 'regexp command args...', the trigger is matched against
+the path of each -in file as it is opened, rather than its contents, and fires
+at most once per file. The regexp extends to the first space, and the rest is
+split into words as by the shell. The flag may be repeated. Submatches refer
+to the path, so $0 is the matched portion of the path. The line filters of
+-since and -valid-utf8-only do not apply to the paths, and file triggers write
+no -gnu-format records.
+
+With -gnu-format path, the location of each match is written to the named
+file in the format "file:line:col: text", as reported by compilers, where file
+is the name of the input file (or "-" for stdin), col is the byte offset of
+the match in the line counting from 1, and text is the matched text. This
+requires line-mode patterns. Lines not matched because of -decode or
+-valid-utf8-only are not counted. A command is optional with -gnu-format.
+
+With -progress, the number of bytes read and matches found is reported on
+stderr every -progress-every, but only if stderr is a terminal unless
+-progress=always is set. Since the status line would be interleaved with their
+output, -progress requires -cout to redirect the output of commands whenever
+the status is shown.
+
+If the input is a regular file, -tail-lines skips all but the last lines of
+the file, as tail -n, before any of it is copied or matched. It cannot be used
+with -inplace, since the skipped lines would be lost from the file. Lines are
+found by their newline bytes, so -tail-lines cannot be used with the UTF-16
+encodings.
+
+Input is assumed to be UTF-8 and is not transformed. If -encoding is set to
+another encoding (utf-16, utf-16le, utf-16be, latin1, windows-1252), the input
+is decoded to UTF-8 before matching. The passthrough to stdout copies the raw
+input bytes unless -decode-output is set.
+
+With -valid-utf8-only, input lines that are not valid UTF-8 are not matched
+by any trigger. This affects matching only; such lines are still copied to
+stdout unchanged.
+
+With -crlf, each CRLF sequence in the input is converted to LF before it is
+matched, so that patterns need not account for the CR. The passthrough to
+stdout is not affected, but the match text given to commands reflects the
+converted input.
 
 Options:
 `, filepath.Base(os.Args[0]))
 
 		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "\nTrigger options:")
+		fs := triggerFlags(new(trigger))
+		fs.SetOutput(os.Stderr)
+		fs.PrintDefaults()
 	}
 }
 
 func main() {
 	flag.Parse()
+	if *since != "" {
+		f, err := newSinceFilter(*since, *tsFormat, *tsPattern, *tsKeepBad)
+		if err != nil {
+			log.Fatalf("Timestamp filter: %v", err)
+		}
+		sinceFilter = f
+	}
+	rules := splitArgs(flag.Args())
+	if *doCheck {
+		os.Exit(checkTriggers(rules))
+	} else if *listCaps {
+		os.Exit(listCaptures(rules))
+	}
+	os.Exit(run(rules))
+}
+
+// run processes the input with the triggers described by rules, and returns
+// the exit status for the program.
+func run(rules [][]string) (status int) {
+	defer func() {
+		// Deferred first, so this runs after the triggers have finished, and
+		// sees the status of a -fail-fast failure by their last commands.
+		status = max(status, int(exitStatus.Load()), int(failStatus.Load()))
+	}()
 
-	if *cmdOutFile != "" {
-		f, err := os.OpenFile(*cmdOutFile, os.O_WRONLY|os.O_CREATE, 0600)
+	if strings.Contains(*cmdOutFile, "$") {
+		if *maxOpenOut <= 0 {
+			log.Fatal("The -cout-max-open flag must be positive")
+		} else if err := checkTemplate(*cmdOutFile); err != nil {
+			log.Fatalf("Command output: %v", err)
+		}
+		outFiles = newOutputCache(*maxOpenOut)
+		defer outFiles.closeAll()
+	} else if *cmdOutFile != "" {
+		f, err := os.OpenFile(*cmdOutFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 		if err != nil {
 			log.Fatalf("Command output: %v", err)
 		}
 		cmdOutput = f
+		if *coutMax > 0 {
+			size := int64(0)
+			if fi, err := f.Stat(); err == nil {
+				size = fi.Size()
+			}
+			cmdOutput = newCapWriter(f, *cmdOutFile, size)
+		}
 		defer func() {
 			if err := f.Close(); err != nil {
 				log.Printf("Closing command output: %v", err)
 			}
 		}()
 	}
-
-	out := []io.Writer{os.Stdout}
-	for i, rule := range splitArgs(flag.Args()) {
-		t, err := parseTrigger(rule)
+	if (*tmplText != "") != (*tmplFile != "") {
+		log.Fatal("The -template and -template-out flags must be used together")
+	} else if *tmplText != "" {
+		tmpl, err := parseOutputTemplate(*tmplText)
 		if err != nil {
-			log.Fatalf("Parsing trigger %d: %v", i+1, err)
+			log.Fatalf("Invalid -template: %v", err)
 		}
-		diag("Trigger %d: pattern=%q command=%s line=%v pipe=%v", i+1, t.re, t.cmd, !t.multi, t.isPipe)
-		out = append(out, t)
-		defer t.Close()
-	}
-	_, err := io.Copy(io.MultiWriter(out...), bufio.NewReader(os.Stdin))
-	if err != nil {
-		log.Printf("Copy failed: %v", err)
+		f, err := openRecordFile(*tmplFile, os.O_TRUNC)
+		if err != nil {
+			log.Fatalf("Template output: %v", err)
+		}
+		tmplOut = &templateOutput{tmpl: tmpl, out: f}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Printf("Closing template output: %v", err)
+			}
+		}()
 	}
-}
-
-func diag(msg string, args ...interface{}) {
-	if *doVerbose {
-		log.Printf(msg, args...)
+	if *extractFile != "" {
+		f, err := openRecordFile(*extractFile, os.O_TRUNC)
+		if err != nil {
+			log.Fatalf("Extract output: %v", err)
+		}
+		extractOut = f
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Printf("Closing extract output: %v", err)
+			}
+		}()
 	}
-}
-
-// splitArgs partitions args into candidate trigger groups, separated by "--"
-// arguments. It returns an empty slice if there are no trigger groups.
-func splitArgs(args []string) [][]string {
-	var cmds [][]string
-	var cur []string
-	for _, arg := range args {
-		if arg == "--" {
-			cmds = append(cmds, cur)
-			cur = nil
-		} else {
-			cur = append(cur, arg)
+	if *gnuFile != "" {
+		f, err := openRecordFile(*gnuFile, os.O_TRUNC)
+		if err != nil {
+			log.Fatalf("Match locations: %v", err)
 		}
+		gnuOut = f
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Printf("Closing match locations: %v", err)
+			}
+		}()
 	}
-	if len(cur) != 0 {
-		cmds = append(cmds, cur)
+	if *exitFile != "" {
+		f, err := openRecordFile(*exitFile, os.O_APPEND)
+		if err != nil {
+			log.Fatalf("Exit log: %v", err)
+		}
+		exitLog = f
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Printf("Closing exit log: %v", err)
+			}
+		}()
 	}
-	return cmds
-}
-
-// hasMulti reports whether rt contains any subexpressions that allow
-// multi-line matches. Since the regexp parser lowers top-level flags it is not
-// sufficient to check only the root.
-func hasMulti(rt *syntax.Regexp) bool {
-	if rt.Flags != 0 && rt.Flags&syntax.OneLine == 0 {
-		return true
+	if *mergeOut && (*cmdOutFile != "" || *cmdErrFile != "" || *errToOut) {
+		log.Fatal("The -merge-cmd-output flag cannot be combined with -cout, -cerr, or -cerr-cout")
 	}
-	for _, sub := range rt.Sub {
-		if hasMulti(sub) {
-			return true
+	if *cmdErrFile != "" {
+		if *errToOut {
+			log.Fatal("The -cerr and -cerr-cout flags are mutually exclusive")
 		}
-	}
-	return false
-}
-
-// parseTrigger parses args as a trigger group consisting of a regexp pattern,
-// a command, and optional arguments.
-func parseTrigger(args []string) (*trigger, error) {
-	switch len(args) {
-	case 0:
-		return nil, errors.New("missing regexp and command")
-	case 1:
-		return nil, errors.New("missing command")
+		f, err := os.OpenFile(*cmdErrFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Command error output: %v", err)
+		}
+		cmdErrors = f
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Printf("Closing command error output: %v", err)
+			}
+		}()
 	}
 
-	// Parse the pattern and check its flags for multi-line support.
-	rt, err := syntax.Parse(args[0], syntax.Perl) // as regexp.Compile
+	enc, err := inputEncoding(*inEncoding)
 	if err != nil {
-		return nil, fmt.Errorf("pattern: %v", err)
+		log.Fatalf("Input encoding: %v", err)
 	}
-
-	cmd := strings.TrimPrefix(args[1], ":")
-	return &trigger{
-		re:     regexp.MustCompile(rt.String()),
-		cmd:    cmd,
-		isPipe: cmd != args[1],
-		args:   args[2:],
-		multi:  hasMulti(rt),
-		sync:   make(chan struct{}, 1),
-		buf:    bytes.NewBuffer(nil),
-	}, nil
-}
-
-type trigger struct {
-	re     *regexp.Regexp // the compiled pattern
-	cmd    string         // the name of the command to run
-	isPipe bool           // whether to pipe match text to stdin
-	args   []string       // command arguments (optional)
-	multi  bool           // allow multi-line matches?
-	sync   chan struct{}  // to sequence subprocesses
-
-	mu  sync.Mutex    // gates access to the buffer
-	buf *bytes.Buffer // buffered input for matches
-}
-
-// hasMatch reports whether the buffer currently contains a match for the
-// pattern, and if so returns the matching indices and the prefix of the buffer
-// containing the match. The caller must hold t.mu.
-//
-// If closing == true, a line match will be attempted even if the buffer does
-// not contain a newline.
-func (t *trigger) hasMatch(closing bool) ([]int, string, bool) {
-	if t.multi {
-		// Check for a match of the regexp.
-		m := t.re.FindSubmatchIndex(t.buf.Bytes())
-		if m == nil {
-			// Discard data in excess of the buffer size limit.
-			if t.buf.Len() > *bufLimit {
-				t.buf.Next(t.buf.Len() - *bufLimit)
-			}
-			return nil, "", false
+	if *execUser != "" {
+		attr, err := userAttr(*execUser)
+		if err != nil {
+			log.Fatalf("Command user: %v", err)
 		}
-		return m, string(t.buf.Next(m[1])), true
+		procAttr = attr
 	}
-
-	// Scan ahead line-by-line, looking for a match.
-	for t.buf.Len() > 0 {
-		var line []byte
-
-		if i := bytes.IndexByte(t.buf.Bytes(), '\n'); i >= 0 {
-			line = t.buf.Next(i + 1)[:i]
-		} else if closing {
-			line = t.buf.Next(t.buf.Len())
-		} else {
-			break
+	if *lockPath != "" {
+		l, err := openFileLock(*lockPath)
+		if err != nil {
+			log.Fatalf("Lock file: %v", err)
+		} else if err := l.lock(); err != nil {
+			log.Fatalf("Lock file: %v", err)
+		} else if err := l.unlock(); err != nil {
+			log.Fatalf("Lock file: %v", err)
 		}
-		m := t.re.FindSubmatchIndex(line)
-		if m != nil {
-			return m, string(line), true
+		cmdLock = l
+	}
+	if *interp != "" {
+		path, err := exec.LookPath(*interp)
+		if err != nil {
+			log.Fatalf("Interpreter: %v", err)
 		}
-
-		// No match on this line, but see if there are more
+		*interp = path
 	}
-	return nil, "", false
-}
-
-// fire starts a subprocess to handle a pattern match with the given submatch
-// indices m and content text.
-func (t *trigger) fire(m []int, text string) {
-	diag("Match pattern=%q indices=%v text=%q", t.re, m, text)
-
-	// Substitute any submatches into the command line.
-	var args []string
-	for _, arg := range t.args {
-		repl := t.re.ExpandString(nil, arg, text, m)
-		args = append(args, string(repl))
+	if *execUmask != "" {
+		if v, err := strconv.ParseUint(*execUmask, 8, 32); err != nil || v > 0777 {
+			log.Fatalf("Invalid -exec-umask %q", *execUmask)
+		} else if err := withUmask(exec.Command("true"), *execUmask); err != nil {
+			log.Fatalf("Command umask: %v", err)
+		}
 	}
-	diag("Running command: %s %s", t.cmd, shell.Join(args))
-
-	proc := exec.Command(t.cmd, args...)
-	proc.Stdout = cmdOutput
-	proc.Stderr = os.Stderr
-	if t.isPipe {
-		proc.Stdin = strings.NewReader(text)
+	if *cmdStdin != "" {
+		if _, err := os.Stat(*cmdStdin); err != nil {
+			log.Fatalf("Command input: %v", err)
+		}
 	}
-	if err := proc.Run(); err != nil {
-		log.Printf("Error: executing %q: %v", t.cmd, err)
+	if *syncFire && *workers > 1 {
+		log.Fatal("The -sync-fire and -trigger-workers flags are mutually exclusive")
 	}
-}
-
-// Write implements the io.Writer interface.  Data are copied into the internal
-// buffer, and if this results in a match the trigger is fired in a goroutine.
-func (t *trigger) Write(data []byte) (int, error) {
-	t.mu.Lock()
-	nw, err := t.buf.Write(data)
-	for t.dispatch(false) { // not closing
+	if *winMatch && (*winOverlap <= 0 || *winOverlap > *bufLimit) {
+		log.Fatal("The -window-overlap must be positive and at most -buf")
 	}
-	t.mu.Unlock()
-	return nw, err
-}
-
-// dispatch reports whether there is a match in the buffer, and if so
-// dispatches a subprocess to handle it.  The caller must hold t.mu.
-func (t *trigger) dispatch(closing bool) bool {
-	m, text, ok := t.hasMatch(closing)
-	if !ok {
-		return false
+	if *maxExit && *maxFires <= 0 {
+		log.Fatal("The -max-fires-exit flag requires -max-fires > 0")
+	}
+	if progress.enabled() && *cmdOutFile == "" {
+		log.Fatal("The -progress flag requires -cout")
+	}
+	paths, err := expandInputs(inputFiles)
+	if err != nil {
+		log.Fatalf("Input files: %v", err)
+	} else if len(paths) != 0 && *inPlace != "" {
+		log.Fatal("The -in and -inplace flags are mutually exclusive")
+	} else if len(paths) > 1 && *tailLines > 0 {
+		log.Fatal("The -tail-lines flag requires a single input file")
+	} else if *watchPath != "" && (len(paths) != 0 || *inPlace != "" || *tailLines > 0 || *gnuFile != "") {
+		log.Fatal("The -watch flag cannot be combined with -in, -inplace, -tail-lines, or -gnu-format")
+	} else if *paragraph && *gnuFile != "" {
+		log.Fatal("The -paragraph and -gnu-format flags are mutually exclusive")
+	} else if len(fileRules) != 0 && len(paths) == 0 {
+		log.Fatal("The -file-trigger flag requires -in")
+	} else if *keepEvery > 0 && *inPlace != "" {
+		log.Fatal("The -keepalive-interval and -inplace flags are mutually exclusive")
+	} else if *tailLines > 0 && *inPlace != "" {
+		log.Fatal("The -tail-lines and -inplace flags are mutually exclusive")
+	} else if _, ok := enc.(*charmap.Charmap); *tailLines > 0 && enc != nil && !ok {
+		log.Fatalf("The -tail-lines flag cannot be used with -encoding %s", *inEncoding)
+	} else if *mergeOut && *inPlace != "" {
+		log.Fatal("The -merge-cmd-output and -inplace flags are mutually exclusive")
+	}
+	if *beforeCmd != "" {
+		words, ok := shell.Split(*beforeCmd)
+		if !ok || len(words) == 0 {
+			log.Fatalf("Invalid -before %q", *beforeCmd)
+		} else if err := runBefore(words, *beforeRetry, *beforeWait); err != nil {
+			log.Fatalf("Before command: %v", err)
+		}
+	} else if *beforeRetry > 0 {
+		log.Fatal("The -before-retry flag requires -before")
+	}
+	if (*beatEvery > 0) != (*beatCmd != "") {
+		log.Fatal("The -every-interval and -every-cmd flags must be used together")
+	} else if *beatEvery > 0 {
+		words, ok := shell.Split(*beatCmd)
+		if !ok || len(words) == 0 {
+			log.Fatalf("Invalid -every-cmd %q", *beatCmd)
+		}
+		defer startHeartbeat(*beatEvery, words)()
+	}
+
+	// Set up the standard output before the triggers, so that it is flushed
+	// after they have finished.
+	input, output := os.Stdin, os.Stdout
+	var edit *inPlaceEdit
+	var clean bool       // input was copied to completion without error
+	var reader io.Reader // if not nil, read input from here instead
+	switch {
+	case *inPlace != "":
+		e, err := beginInPlace(*inPlace)
+		if err != nil {
+			log.Fatalf("Editing in place: %v", err)
+		}
+		edit, input, output = e, e.in, e.tmp
+		setInputName(*inPlace)
+	case len(paths) == 1:
+		f, err := os.Open(paths[0])
+		if err != nil {
+			log.Fatalf("Input file: %v", err)
+		}
+		defer f.Close()
+		input = f
+		setInputName(paths[0])
+	case len(paths) > 1:
+		files := &fileReader{paths: paths}
+		defer files.Close()
+		reader = files
+	case *watchPath != "":
+		w, err := watchDir(*watchPath, *watchEvery)
+		if err != nil {
+			log.Fatalf("Watching %q: %v", *watchPath, err)
+		}
+		reader = w
+	}
+	stdout = newOutputWriter(output, *outBuf, *outFlush)
+	defer func() {
+		err := stdout.Close()
+		if err != nil {
+			log.Printf("Flushing output: %v", err)
+		}
+		if edit != nil {
+			commit := clean && err == nil && exitStatus.Load() == 0
+			if err := edit.finish(commit); err != nil {
+				log.Printf("Editing in place: %v", err)
+			} else if !commit {
+				log.Printf("Editing in place: %q was not modified", edit.path)
+			}
+		}
+	}()
+
+	var trigs []*trigger
+	for i, rule := range rules {
+		t, err := parseTrigger(rule)
+		if err != nil {
+			log.Fatalf("Parsing trigger %d: %v", i+1, err)
+		}
+		t.filters = append(inputFilters(), t.filters...)
+		diag("Trigger %d: %s", i+1, t.describe())
+		t.id = i + 1
+		if t.persist && t.cmd != "" && !t.disabled.Load() {
+			if err := t.startFilter(); err != nil {
+				log.Fatalf("Trigger %d: %v", t.id, err)
+			}
+		}
+		trigs = append(trigs, t)
+		defer t.Close()
+	}
+	for i, rule := range fileRules {
+		t, err := parseTrigger(rule)
+		if err != nil {
+			log.Fatalf("Parsing file trigger %d: %v", i+1, err)
+		}
+		t.id = len(trigs) + i + 1
+		t.onPaths = true
+		diag("Trigger %d (files): %s", t.id, t.describe())
+		fileTriggers = append(fileTriggers, t)
+		defer t.Close()
+	}
+	if *csvPath != "" {
+		f, err := openCSVFile(*csvPath, slices.Concat(trigs, fileTriggers))
+		if err != nil {
+			log.Fatalf("CSV output: %v", err)
+		}
+		csvOut = f
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Printf("Closing CSV output: %v", err)
+			}
+		}()
+	}
+	if *maxExit && len(trigs) != 0 {
+		var ncapped atomic.Int32
+		for _, t := range trigs {
+			t.capped = func() {
+				if int(ncapped.Add(1)) == len(trigs) {
+					stopInput("all triggers reached -max-fires")
+				}
+			}
+		}
+	}
+
+	handleMuteSignals(trigs)
+	if *serial {
+		serialQueue = make(chan func())
+		go func() {
+			for run := range serialQueue {
+				run()
+			}
+		}()
+	}
+
+	// With several files, the fileReader offers each path to the file
+	// triggers as it opens the file.
+	if len(paths) == 1 {
+		matchFile(paths[0])
+	}
+
+	var tw []io.Writer
+	if *sharedBuf && len(trigs) > 1 {
+		tw = append(tw, newSharedInput(trigs))
+	} else {
+		for _, t := range trigs {
+			tw = append(tw, t)
+		}
+	}
+
+	if *tailLines > 0 {
+		if err := seekTail(input, *tailLines); err != nil {
+			log.Fatalf("Seeking to -tail-lines: %v", err)
+		}
+	}
+
+	// If the input requires decoding, either decode it before it is copied
+	// anywhere, or decode only the copy that is sent to the triggers. Other
+	// transformations apply only to the triggers.
+	var in io.Reader = bufio.NewReader(input)
+	if reader != nil {
+		in = bufio.NewReader(reader)
+	}
+	if progress.enabled() {
+		pr := newProgressReader(in, *progEvery)
+		defer pr.Stop()
+		in = pr
+	}
+	var xs []transform.Transformer
+	if enc != nil {
+		if *decodeOut {
+			in = transform.NewReader(in, enc.NewDecoder())
+		} else {
+			xs = append(xs, enc.NewDecoder())
+		}
+	}
+	if *crlf {
+		xs = append(xs, crlfTransformer{})
+	}
+
+	// If any triggers make substitutions, apply them to the output.
+	var rw *rewriter
+	for _, t := range trigs {
+		if t.replacing {
+			if rw == nil {
+				rw = &rewriter{w: stdout}
+			}
+			rw.trigs = append(rw.trigs, t)
+		}
+	}
+
+	if *workers > 1 && len(tw) > 1 {
+		tw = []io.Writer{newParallelWriter(tw, *workers)}
+	}
+
+	var dw io.WriteCloser
+	out := []io.Writer{stdout}
+	if rw != nil {
+		out[0] = rw
+	}
+	if len(xs) == 0 {
+		out = append(out, tw...)
+	} else {
+		dw = transform.NewWriter(io.MultiWriter(tw...), transform.Chain(xs...))
+		out = append(out, dw)
+	}
+	var w io.Writer = io.MultiWriter(out...)
+	if *idleExit > 0 {
+		iw := newIdleWriter(w, *idleExit, false, func() {
+			stopInput(fmt.Sprintf("no input for %v", *idleExit))
+		})
+		defer iw.timer.Stop()
+		w = iw
+	}
+	if *keepEvery > 0 {
+		text := []byte(*keepText + "\n")
+		iw := newIdleWriter(w, *keepEvery, true, func() {
+			if err := stdout.Keepalive(text); err != nil {
+				log.Printf("Writing keepalive: %v", err)
+			}
+		})
+		defer iw.timer.Stop()
+		w = iw
+	}
+	if err := copyInput(w, in); errors.Is(err, errStopped) {
+		// Finish as at the end of the input, but the input is incomplete, so
+		// do not replace an -inplace file.
+	} else if err != nil {
+		log.Printf("Copy failed: %v", err)
+	} else {
+		clean = true
+	}
+	if rw != nil {
+		if err := rw.Flush(); err != nil {
+			log.Printf("Writing output: %v", err)
+			clean = false
+		}
+	}
+	if *ensureNL {
+		if err := stdout.EnsureNewline(); err != nil {
+			log.Printf("Writing output: %v", err)
+		}
+	}
+	if dw != nil {
+		if err := dw.Close(); err != nil {
+			log.Printf("Transforming input: %v", err)
+		}
+	}
+	if *sortOutput {
+		for _, t := range trigs {
+			t.mu.Lock()
+			t.drain()
+			t.mu.Unlock()
+		}
+		sorted.release()
+	}
+	return int(exitStatus.Load())
+}
+
+// checkMemory adds delta to the total number of bytes buffered by triggers,
+// and stops input processing if the total exceeds -max-memory.
+func checkMemory(delta int64) {
+	if delta == 0 || *maxMemory <= 0 {
+		return
+	}
+	if total := buffered.Add(delta); total > *maxMemory && exitStatus.CompareAndSwap(0, 1) {
+		log.Printf("Error: buffered input (%d bytes) exceeds -max-memory (%d bytes); stopping", total, *maxMemory)
+		stopInput("buffered input exceeds -max-memory")
+	}
+}
+
+// handleMuteSignals starts a goroutine to mute the -mutable triggers among
+// trigs on receipt of muteSignal, and unmute them on unmuteSignal. With
+// -mute-file, only the triggers it lists are affected.
+func handleMuteSignals(trigs []*trigger) {
+	var mutable []*trigger
+	for _, t := range trigs {
+		if t.mutable {
+			mutable = append(mutable, t)
+		}
+	}
+	if len(mutable) == 0 {
+		return
+	} else if muteSignal == nil {
+		log.Fatal("The -mutable trigger option is not supported on this platform")
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, muteSignal, unmuteSignal)
+	go func() {
+		for s := range sig {
+			mute := s == muteSignal
+			sel, err := readMuteFile()
+			if err != nil {
+				log.Printf("Error: reading -mute-file: %v", err)
+				continue
+			}
+			for _, t := range mutable {
+				if sel != nil && !sel[t.id] {
+					continue
+				}
+				t.mu.Lock()
+				t.muted = mute
+				t.mu.Unlock()
+				diag("Trigger %d: muted=%v", t.id, mute)
+			}
+		}
+	}()
+}
+
+// readMuteFile returns the set of trigger numbers listed in the -mute-file, or
+// nil if it is not set.
+func readMuteFile() (map[int]bool, error) {
+	if *muteFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(*muteFile)
+	if err != nil {
+		return nil, err
+	}
+	sel := make(map[int]bool)
+	for _, f := range strings.Fields(string(data)) {
+		id, err := strconv.Atoi(f)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid trigger number %q", f)
+		}
+		sel[id] = true
+	}
+	return sel, nil
+}
+
+// copyInput copies from r to w until EOF, or until stopInput is called.
+// If input processing was stopped, it returns errStopped once any write in
+// progress has finished, without waiting for a pending read. No further data
+// are written to w after it returns.
+func copyInput(w io.Writer, r io.Reader) error {
+	sw := &stopWriter{w: w}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(sw, r)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-stopped:
+		sw.mu.Lock() // wait for a write in progress
+		defer sw.mu.Unlock()
+		return errStopped
+	}
+}
+
+// stopWriter is an io.Writer that delegates to an underlying writer until
+// input processing is stopped, after which it reports errStopped.
+type stopWriter struct {
+	mu sync.Mutex // held while writing to w
+	w  io.Writer
+}
+
+func (s *stopWriter) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-stopped:
+		return 0, errStopped
+	default:
+		return s.w.Write(data)
+	}
+}
+
+// An idleWriter is an io.Writer that delegates to an underlying writer, and
+// calls a function if no write begins within a given duration of the end of
+// the previous one (or of its creation). If repeat is true, the function is
+// called again after each further such duration until a write begins.
+type idleWriter struct {
+	w     io.Writer
+	d     time.Duration
+	timer *time.Timer
+}
+
+func newIdleWriter(w io.Writer, d time.Duration, repeat bool, idle func()) *idleWriter {
+	i := &idleWriter{w: w, d: d}
+	i.timer = time.AfterFunc(d, func() {
+		idle()
+		if repeat {
+			i.timer.Reset(d)
+		}
+	})
+	return i
+}
+
+func (i *idleWriter) Write(data []byte) (int, error) {
+	i.timer.Stop() // time spent handling the input does not count
+	defer i.timer.Reset(i.d)
+	return i.w.Write(data)
+}
+
+// truncMarker is written in place of command output beyond -max-cmd-output.
+const truncMarker = "\n[output truncated]\n"
+
+// A limitWriter is an io.Writer that passes at most n bytes to an underlying
+// writer, followed by truncMarker if more are written. Excess bytes are
+// discarded, but reported as written.
+type limitWriter struct {
+	w         io.Writer
+	n         int64 // bytes remaining
+	truncated bool
+}
+
+func (l *limitWriter) Write(data []byte) (int, error) {
+	if int64(len(data)) <= l.n {
+		nw, err := l.w.Write(data)
+		l.n -= int64(nw)
+		return nw, err
+	}
+	if l.n > 0 {
+		if _, err := l.w.Write(data[:l.n]); err != nil {
+			return 0, err
+		}
+		l.n = 0
+	}
+	if !l.truncated {
+		l.truncated = true
+		if _, err := io.WriteString(l.w, truncMarker); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// A capWriter is an io.Writer that passes data to a command output file until
+// the file reaches -cout-max-size bytes, and discards the rest. Discarded bytes
+// are reported as written, so that commands do not fail. It is safe for
+// concurrent use by multiple commands.
+type capWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	path string
+	n    int64 // bytes remaining
+}
+
+// newCapWriter returns a capWriter for w, the file at path, which already
+// holds size bytes.
+func newCapWriter(w io.Writer, path string, size int64) *capWriter {
+	return &capWriter{w: w, path: path, n: max(0, *coutMax-size)}
+}
+
+func (c *capWriter) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n <= 0 {
+		return len(data), nil // already full
+	}
+	nw, err := c.w.Write(data[:min(c.n, int64(len(data)))])
+	c.n -= int64(nw)
+	if err != nil {
+		return nw, err
+	} else if c.n <= 0 {
+		log.Printf("Command output %q reached -cout-max-size (%d bytes); discarding further output", c.path, *coutMax)
+	}
+	return len(data), nil
+}
+
+// seekTail positions f at the start of its nth line from the end, or at the
+// beginning if it has fewer than n lines. A final line without a trailing
+// newline is counted as a line. The file must be seekable.
+func seekTail(f *os.File, n int) error {
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	// Scan backward in blocks, counting newlines. The newline that ends the
+	// last line (if any) does not separate it from a following line.
+	const blockSize = 1 << 14
+	buf := make([]byte, blockSize)
+	pos := end
+	for pos > 0 {
+		size := min(pos, blockSize)
+		pos -= size
+		if _, err := f.ReadAt(buf[:size], pos); err != nil {
+			return err
+		}
+		for i := size - 1; i >= 0; i-- {
+			if buf[i] != '\n' || pos+i == end-1 {
+				continue
+			}
+			if n--; n == 0 {
+				_, err := f.Seek(pos+i+1, io.SeekStart)
+				return err
+			}
+		}
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// crlfTransformer is a transform.Transformer that replaces each CRLF
+// sequence with a single LF.
+type crlfTransformer struct{ transform.NopResetter }
+
+func (crlfTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		c := src[nSrc]
+		if c == '\r' {
+			if nSrc+1 == len(src) && !atEOF {
+				return nDst, nSrc, transform.ErrShortSrc // wait for the next byte
+			} else if nSrc+1 < len(src) && src[nSrc+1] == '\n' {
+				nSrc++ // drop the CR
+				continue
+			}
+		}
+		if nDst == len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		dst[nDst] = c
+		nDst++
+		nSrc++
+	}
+	return nDst, nSrc, nil
+}
+
+// inputEncoding returns the encoding for the specified name, or nil if the
+// name denotes UTF-8, for which no transformation is needed.
+func inputEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	case "utf-16", "utf16":
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	case "utf-16le", "utf16le":
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), nil
+	case "utf-16be", "utf16be":
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), nil
+	case "latin1", "latin-1", "iso-8859-1":
+		return charmap.ISO8859_1, nil
+	case "windows-1252", "cp1252":
+		return charmap.Windows1252, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+}
+
+// commandOptional reports whether triggers may omit a command, because their
+// matches are written to an output file.
+func commandOptional() bool {
+	return *extractFile != "" || *gnuFile != "" || *csvPath != "" || *tmplText != ""
+}
+
+// noCommand reports whether the trigger's options let it do without a
+// command.
+func (t *trigger) noCommand() bool {
+	return t.webhook != "" || t.replacing || t.replMapFile != "" || t.countBy != ""
+}
+
+// listCaptures parses each of the trigger groups in rules and the
+// -file-trigger groups, and prints the submatches each pattern defines, for
+// -list-captures. It returns 0 if all the triggers are valid, otherwise 1.
+func listCaptures(rules [][]string) int {
+	code := 0
+	for i, rule := range rules {
+		t, err := parseTrigger(rule)
+		if err != nil {
+			log.Printf("Trigger %d: invalid: %v", i+1, err)
+			code = 1
+			continue
+		}
+		printCaptures(fmt.Sprintf("Trigger %d", i+1), t)
+	}
+	for i, rule := range fileRules {
+		t, err := parseTrigger(rule)
+		if err != nil {
+			log.Printf("File trigger %d: invalid: %v", i+1, err)
+			code = 1
+			continue
+		}
+		printCaptures(fmt.Sprintf("File trigger %d", i+1), t)
+	}
+	return code
+}
+
+// printCaptures prints the submatches defined by the pattern of t, labelled
+// with the given name.
+func printCaptures(label string, t *trigger) {
+	fmt.Printf("%s: %s\n", label, t.re)
+	for j, name := range t.re.SubexpNames() {
+		if name != "" {
+			fmt.Printf("  $%d ${%s}\n", j, name)
+		} else {
+			fmt.Printf("  $%d\n", j)
+		}
+	}
+}
+
+// checkTriggers parses each of the trigger groups in rules and logs the
+// resulting configuration, for -check. It returns 0 if all the triggers are
+// valid, otherwise 1.
+func checkTriggers(rules [][]string) int {
+	code := 0
+	for i, rule := range rules {
+		t, err := parseTrigger(rule)
+		if err != nil {
+			log.Printf("Trigger %d: invalid: %v", i+1, err)
+			code = 1
+			continue
+		}
+		log.Printf("Trigger %d: %s", i+1, t.describe())
+	}
+	for i, rule := range fileRules {
+		t, err := parseTrigger(rule)
+		if err != nil {
+			log.Printf("File trigger %d: invalid: %v", i+1, err)
+			code = 1
+			continue
+		}
+		log.Printf("File trigger %d: %s", i+1, t.describe())
+	}
+	return code
+}
+
+func diag(msg string, args ...interface{}) {
+	if *doVerbose {
+		log.Printf(msg, args...)
+	}
+}
+
+// splitArgs partitions args into candidate trigger groups, separated by "--"
+// arguments. It returns an empty slice if there are no trigger groups.
+func splitArgs(args []string) [][]string {
+	var cmds [][]string
+	var cur []string
+	for _, arg := range args {
+		if arg == "--" {
+			cmds = append(cmds, cur)
+			cur = nil
+		} else {
+			cur = append(cur, arg)
+		}
+	}
+	if len(cur) != 0 {
+		cmds = append(cmds, cur)
+	}
+	return cmds
+}
+
+// hasMulti reports whether rt contains any subexpressions that allow
+// multi-line matches. Since the regexp parser lowers top-level flags it is not
+// sufficient to check only the root.
+func hasMulti(rt *syntax.Regexp) bool {
+	if rt.Flags != 0 && rt.Flags&syntax.OneLine == 0 {
+		return true
+	}
+	for _, sub := range rt.Sub {
+		if hasMulti(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrigger parses args as a trigger group consisting of a regexp pattern,
+// a command, and optional arguments.
+func parseTrigger(args []string) (*trigger, error) {
+	t := &trigger{
+		sync: make(chan struct{}, 1),
+		buf:  bytes.NewBuffer(nil),
+	}
+	fs := triggerFlags(t)
+	n := optionWords(fs, args)
+	if err := fs.Parse(args[:n]); err != nil {
+		return nil, err
+	}
+	args = args[n:]
+
+	switch {
+	case len(args) == 0:
+		return nil, errors.New("missing regexp and command")
+	case len(args) == 1 && !commandOptional() && !t.noCommand():
+		return nil, errors.New("missing command")
+	case len(args) > 1 && t.webhook != "":
+		return nil, errors.New("webhook: a trigger cannot have both a command and a webhook")
+	}
+
+	// Parse the pattern and check its flags for multi-line support.
+	flags := syntax.Perl // as regexp.Compile
+	if *posixRE {
+		flags = syntax.POSIX // as regexp.CompilePOSIX
+	}
+	rt, err := syntax.Parse(args[0], flags)
+	if err != nil {
+		return nil, fmt.Errorf("pattern: %v", err)
+	}
+
+	if t.asciiFold {
+		foldASCII(rt)
+	}
+	re := regexp.MustCompile(rt.String())
+	if *posixRE {
+		re.Longest()
+	}
+
+	// If the pattern is a plain literal string, we can avoid the regexp
+	// engine when searching for it.
+	var lit []byte
+	if pfx, complete := re.LiteralPrefix(); complete && pfx != "" && re.NumSubexp() == 0 {
+		lit = []byte(pfx)
+	}
+	t.re = re
+	t.lit = lit
+	t.multi = hasMulti(rt)
+	if len(args) > 1 {
+		t.cmd = strings.TrimPrefix(args[1], ":")
+		t.isPipe = t.cmd != args[1]
+		t.args = args[2:]
+		if cmd, ok := strings.CutPrefix(args[1], ":::"); ok {
+			t.cmd, t.subsIn = cmd, true
+		}
+	}
+	if t.subsIn {
+		if re.NumSubexp() == 0 {
+			return nil, errors.New("a ::: command requires a pattern with submatches")
+		} else if t.persist || t.fan || t.pipeContext != 0 {
+			return nil, errors.New("a ::: command cannot be used with -persist, -fan-submatches, or -pipe-context")
+		}
+	}
+	if name, ok := strings.CutPrefix(t.cmd, "@"); ok {
+		path, err := scriptPath(name)
+		if err != nil {
+			return nil, fmt.Errorf("script: %w", err)
+		}
+		t.cmd, t.script = path, true
+	}
+	if t.distinctFold && t.distinct == "" {
+		return nil, errors.New("distinct-fold: requires -distinct")
+	}
+	if t.distinct != "" && !hasSubmatch(re, t.distinct) {
+		return nil, fmt.Errorf("distinct: no submatch %q in pattern", t.distinct)
+	}
+	if t.countBy != "" && !hasSubmatch(re, t.countBy) {
+		return nil, fmt.Errorf("count-by: no submatch %q in pattern", t.countBy)
+	}
+	if *gnuFile != "" && t.multi {
+		return nil, errors.New("-gnu-format requires a line-mode pattern")
+	}
+	switch t.onBusy {
+	case "block", "queue", "drop":
+	default:
+		return nil, fmt.Errorf("on-busy: invalid policy %q (want block, queue, or drop)", t.onBusy)
+	}
+	if *syncFire && t.onBusy != "block" {
+		return nil, errors.New("on-busy: only the block policy can be used with -sync-fire")
+	}
+	if t.keepPrefix && (!t.multi || *maxLines > 0) {
+		return nil, errors.New("keep-prefix: requires a multi-line pattern without -multi-max-lines")
+	}
+	if t.collapse && t.multi {
+		return nil, errors.New("collapse: runs require a line-mode pattern")
+	}
+	for _, opt := range []struct {
+		name, spec string
+		gt         bool
+	}{{"num-gt", t.numGT, true}, {"num-lt", t.numLT, false}} {
+		if opt.spec == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(opt.spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid threshold %q (want name=value)", opt.name, opt.spec)
+		} else if !hasSubmatch(re, name) {
+			return nil, fmt.Errorf("%s: no submatch %q in pattern", opt.name, name)
+		}
+		limit, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid value %q", opt.name, val)
+		}
+		t.numChecks = append(t.numChecks, numCheck{name: name, limit: limit, gt: opt.gt})
+	}
+	if t.failExit < 0 || t.failExit > 125 {
+		return nil, errors.New("fail-exit: the status must be between 0 and 125")
+	}
+	if t.once && t.last {
+		return nil, errors.New("the -once and -last options are mutually exclusive")
+	}
+	if t.batch < 0 || t.batchWait < 0 {
+		return nil, errors.New("batch: the size and timeout must not be negative")
+	} else if t.batch > 0 && (t.collapse || t.last || t.fan) {
+		return nil, errors.New("batch: cannot be combined with -collapse, -last, or -fan-submatches")
+	} else if t.batchWait > 0 && t.batch == 0 {
+		return nil, errors.New("batch-timeout: requires -batch")
+	}
+	if t.replMapFile != "" {
+		if t.replaceCmd {
+			return nil, errors.New("the -replace-map and -replace-cmd options are mutually exclusive")
+		}
+		m, err := loadReplaceMap(t.replMapFile)
+		if err != nil {
+			return nil, fmt.Errorf("replace-map: %w", err)
+		}
+		t.replMap, t.replFallback = m, t.replacing
+		t.replacing = true
+	}
+	if t.replaceCmd {
+		if t.replacing {
+			return nil, errors.New("the -replace and -replace-cmd options are mutually exclusive")
+		} else if t.cmd == "" {
+			return nil, errors.New("replace-cmd: a command is required")
+		} else if t.persist || t.webhook != "" {
+			return nil, errors.New("replace-cmd: cannot be combined with -persist or -webhook")
+		}
+		t.replacing = true // with no template
+	}
+	if t.replacing {
+		if t.multi {
+			return nil, errors.New("replace: substitutions require a line-mode pattern")
+		} else if err := checkTemplate(t.replace); err != nil {
+			return nil, fmt.Errorf("replace: %w", err)
+		}
+	}
+	if t.ifCmd != "" {
+		words, ok := shell.Split(t.ifCmd)
+		if !ok || len(words) == 0 {
+			return nil, fmt.Errorf("if: invalid command %q", t.ifCmd)
+		}
+		t.cond = words
+	}
+	if t.isPipe && *cmdStdin != "" && t.pipeFile == "" {
+		return nil, errors.New("a pipe command cannot be used with -cmd-stdin")
+	}
+	if (t.pipePrefix != "" || t.pipeSuffix != "") && !t.isPipe {
+		return nil, errors.New("pipe-prefix and pipe-suffix: command is not a pipe")
+	} else if t.pipeContext != 0 && (!t.isPipe || t.pipeFile != "") {
+		return nil, errors.New("pipe-context: command is not a pipe of the match text")
+	} else if t.pipeContext < 0 {
+		return nil, errors.New("pipe-context: must not be negative")
+	}
+	if t.flatten && (!t.isPipe && !t.persist || t.pipeFile != "") {
+		return nil, errors.New("flatten: command is not a pipe of the match text")
+	}
+	if t.gunzip != "" {
+		if !hasSubmatch(re, t.gunzip) {
+			return nil, fmt.Errorf("gunzip-capture: no submatch %q in pattern", t.gunzip)
+		} else if t.fan || t.replaceCmd {
+			return nil, errors.New("gunzip-capture: cannot be combined with -fan-submatches or -replace-cmd")
+		}
+	}
+	if t.pipeFile != "" {
+		if !t.isPipe {
+			return nil, errors.New("pipe-file: command is not a pipe")
+		} else if !hasSubmatch(re, t.pipeFile) {
+			return nil, fmt.Errorf("pipe-file: no submatch %q in pattern", t.pipeFile)
+		}
+	}
+	if t.decode != "" {
+		f, err := decodeFilter(t.decode)
+		if err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+		t.filters = append(t.filters, f)
+	}
+	for _, arg := range t.args {
+		if err := checkTemplate(arg); err != nil {
+			return nil, fmt.Errorf("argument %q: %w", arg, err)
+		}
+	}
+	if err := checkTemplate(t.hookBody); err != nil {
+		return nil, fmt.Errorf("webhook body: %w", err)
+	}
+	if *strictRefs {
+		if err := t.checkRefs(); err != nil {
+			return nil, err
+		}
+	}
+	if t.webhook != "" {
+		if err := checkWebhook(t.webhook); err != nil {
+			return nil, fmt.Errorf("webhook: %w", err)
+		}
+	}
+	if t.cmd == "" || t.script || *interp != "" {
+		return t, nil // no command to check, or it was already checked
+	} else if _, err := exec.LookPath(t.cmd); err != nil {
+		if *strictCmd {
+			return nil, fmt.Errorf("command: %w", err)
+		}
+		t.disable(err)
+	}
+	return t, nil
+}
+
+// checkRefs reports an error if any template of the trigger refers to a
+// submatch that its pattern does not define, for -strict-refs.
+func (t *trigger) checkRefs() error {
+	for _, arg := range t.args {
+		if err := checkRefs(t.re, arg); err != nil {
+			return fmt.Errorf("argument %q: %w", arg, err)
+		}
+	}
+	for _, word := range t.cond {
+		if err := checkRefs(t.re, word); err != nil {
+			return fmt.Errorf("if: argument %q: %w", word, err)
+		}
+	}
+	if t.webhook != "" {
+		if err := checkRefs(t.re, t.hookBody); err != nil {
+			return fmt.Errorf("webhook body: %w", err)
+		}
+	}
+	if t.replacing {
+		if err := checkRefs(t.re, t.replace); err != nil {
+			return fmt.Errorf("replace: %w", err)
+		}
+	}
+	return nil
+}
+
+// optionWords returns the number of leading words of args that are options
+// defined by fs, including their values and any "--" that ends them. The
+// options end at the first word that is not an option of fs, so that a
+// pattern such as "-v" is not mistaken for an option.
+func optionWords(fs *flag.FlagSet, args []string) int {
+	i := 0
+	for i < len(args) {
+		arg := args[i]
+		if arg == "--" {
+			return i + 1
+		} else if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		name, _, hasValue := strings.Cut(strings.TrimPrefix(arg[1:], "-"), "=")
+		f := fs.Lookup(name)
+		if f == nil {
+			break
+		}
+		i++
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && b.IsBoolFlag()) {
+			i++ // the value is the next word
+		}
+	}
+	return min(i, len(args))
+}
+
+// triggerFlags returns a flag set for the per-trigger options, bound to the
+// fields of t.
+func triggerFlags(t *trigger) *flag.FlagSet {
+	fs := flag.NewFlagSet("trigger", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&t.asciiFold, "ignore-case-ascii", false, "Match ASCII letters without regard to case (faster than (?i))")
+	fs.BoolVar(&t.keepPrefix, "keep-prefix", false, "In multi-line mode, keep the input before a match to be matched again")
+	fs.BoolVar(&t.anchored, "anchored", false, "Match only at the start of the buffer (or line)")
+	fs.StringVar(&t.distinct, "distinct", "", "Fire only once for each distinct value of this submatch")
+	fs.BoolVar(&t.distinctFold, "distinct-fold", false, "Compare -distinct values without regard to case")
+	fs.IntVar(&t.distinctMax, "distinct-max", 0, "Remember at most this many -distinct values (0 means unlimited)")
+	fs.StringVar(&t.countBy, "count-by", "", "At exit, print the number of matches for each value of this submatch")
+	fs.IntVar(&t.countMax, "count-max", 0, "Count at most this many -count-by values, and the rest together (0 means unlimited)")
+	fs.StringVar(&t.gunzip, "gunzip-capture", "", "Decompress the gzip data in this submatch and use it as the match text")
+	fs.StringVar(&t.pipeFile, "pipe-file", "", "Pipe the contents of the file named by this submatch to the command")
+	fs.BoolVar(&t.flatten, "flatten", false, "Replace newlines in the piped match text with -flatten-sep")
+	fs.StringVar(&t.flattenSep, "flatten-sep", " ", "The separator that replaces newlines for -flatten")
+	fs.StringVar(&t.pipePrefix, "pipe-prefix", "", "Pipe this text to the command before the match text")
+	fs.StringVar(&t.pipeSuffix, "pipe-suffix", "", "Pipe this text to the command after the match text")
+	fs.IntVar(&t.pipeContext, "pipe-context", 0, "Pipe up to this many bytes of the input preceding the match text")
+	fs.StringVar(&t.ifCmd, "if", "", "Fire only if this command (with submatches) succeeds")
+	fs.StringVar(&t.onBusy, "on-busy", "block", "When a match arrives while the command is running: block, queue, or drop")
+	fs.BoolVar(&t.fan, "fan-submatches", false, "Run the command once for each non-empty submatch, as $0")
+	fs.BoolVar(&t.collapse, "collapse", false, "Fire once for each run of consecutive matching lines")
+	fs.IntVar(&t.batch, "batch", 0, "Fire once for each batch of this many matches")
+	fs.DurationVar(&t.batchWait, "batch-timeout", 0, "Fire for a partial -batch after this long without filling it (0 means never)")
+	fs.StringVar(&t.numGT, "num-gt", "", "Fire only if the number in a submatch exceeds a value, given as name=value")
+	fs.StringVar(&t.numLT, "num-lt", "", "Fire only if the number in a submatch is less than a value, given as name=value")
+	fs.IntVar(&t.failExit, "fail-exit", 0, "Exit with at least this status if any command of the trigger fails")
+	fs.BoolVar(&t.once, "once", false, "Fire only for the first match in the input")
+	fs.BoolVar(&t.last, "last", false, "Fire only for the last match in the input")
+	fs.BoolVar(&t.mutable, "mutable", false, "Allow the trigger to be muted and unmuted by signals")
+	fs.BoolVar(&t.persist, "persist", false, "Run the command once, writing each match to its stdin and copying its output to stdout")
+	fs.StringVar(&t.webhook, "webhook", "", "Send an HTTP request to this URL instead of running a command")
+	fs.StringVar(&t.hookMethod, "webhook-method", "POST", "HTTP method for -webhook")
+	fs.StringVar(&t.hookType, "webhook-type", "text/plain; charset=utf-8", "Content type for -webhook")
+	fs.StringVar(&t.hookBody, "webhook-body", "$0", "Request body for -webhook (may include submatches)")
+	fs.Func("replace", "Replace matches in the output with this template", func(s string) error {
+		t.replace, t.replacing = s, true
+		return nil
+	})
+	fs.StringVar(&t.replMapFile, "replace-map", "", "Replace matches in the output using the table in this file")
+	fs.BoolVar(&t.replaceCmd, "replace-cmd", false, "Replace matches in the output with the output of the command")
+	fs.StringVar(&t.decode, "decode", "", "Decode each input line from this encoding (base64, hex) before matching")
+	return fs
+}
+
+type trigger struct {
+	re     *regexp.Regexp // the compiled pattern
+	lit    []byte         // if not nil, the pattern is exactly this literal
+	cmd    string         // the name of the command to run
+	isPipe bool           // whether to pipe match text to stdin
+	script bool           // the command is a script file ("@path")
+	subsIn bool           // pipe the submatches, one per line (":::command")
+	args   []string       // command arguments (optional)
+	multi  bool           // allow multi-line matches?
+	sync   chan struct{}  // to sequence subprocesses
+	capped func()         // if not nil, called when -max-fires is reached
+	cond   []string       // the -if command and arguments (optional)
+
+	replMap      map[string]string // the -replace-map table, if any
+	replFallback bool              // -replace is set as a fallback for replMap
+
+	// Options set by trigger flags.
+	anchored     bool          // matches must begin at the start of the buffer
+	asciiFold    bool          // match ASCII letters without regard to case
+	keepPrefix   bool          // keep unmatched input before a multi-line match
+	distinct     string        // if set, fire once per distinct value of this submatch
+	distinctMax  int           // maximum number of distinct values to remember
+	distinctFold bool          // compare -distinct values without regard to case
+	countBy      string        // if set, count matches by the value of this submatch
+	countMax     int           // maximum number of -count-by values to count separately
+	decode       string        // if set, decode input lines from this encoding
+	pipeFile     string        // if set, pipe the file named by this submatch
+	gunzip       string        // if set, the match text is this submatch, decompressed
+	flatten      bool          // replace newlines in piped text with flattenSep
+	flattenSep   string        // the separator for flatten
+	pipePrefix   string        // text to pipe to the command before the input
+	pipeSuffix   string        // text to pipe to the command after the input
+	pipeContext  int           // pipe this many bytes of preceding input
+	ifCmd        string        // if set, a command line that must succeed to fire
+	mutable      bool          // the trigger can be muted by signal
+	last         bool          // fire only for the last match, when closing
+	once         bool          // fire only for the first match
+	failExit     int           // if positive, the minimum exit status if a command fails
+	numGT        string        // if set, name=value for a -num-gt threshold
+	numLT        string        // if set, name=value for a -num-lt threshold
+	persist      bool          // run the command once, as a filter
+	onBusy       string        // what to do with a match while the command is running
+	collapse     bool          // fire once for each run of matching lines
+	batch        int           // if positive, fire once for each batch of this many matches
+	batchWait    time.Duration // fire a partial batch after this long
+	fan          bool          // run the command once for each submatch
+	webhook      string        // if set, send an HTTP request here instead of a command
+	hookMethod   string        // the HTTP method for webhook requests
+	hookType     string        // the content type for webhook requests
+	hookBody     string        // the template for webhook request bodies
+	replace      string        // the template for substitutions, if replacing
+	replacing    bool          // replace matches in the output
+	replaceCmd   bool          // replace matches with the output of the command
+	replMapFile  string        // if set, replace matches by looking them up in this file
+
+	id       int                      // the trigger number, for diagnostics
+	onPaths  bool                     // the trigger matches input paths, for -file-trigger
+	disabled atomic.Bool              // the command cannot be run
+	running  atomic.Pointer[exec.Cmd] // the command currently running, if any
+	runner   runner                   // if not nil, runs commands instead of exec
+
+	qmu      sync.Mutex     // protects queue and draining
+	queue    []func()       // pending firings, for -on-busy=queue
+	draining bool           // a goroutine is starting the queued firings
+	pending  sync.WaitGroup // counts firings in queue not yet finished
+	ndropped int            // matches dropped by -on-busy=drop
+
+	failMu      sync.Mutex  // protects nfail and lastFailLog
+	nfail       int         // command failures not yet logged
+	lastFailLog time.Time   // when a command failure was last logged
+	coproc      *filterProc // the running -persist command, if any
+
+	mu     sync.Mutex  // gates access to the buffer
+	buf    matchBuffer // buffered input for matches
+	nfired int         // number of times the trigger has fired
+	done   bool        // the trigger has fired, for -once
+	nbuf   int64       // bytes privately buffered, as last reported to checkMemory
+	muted  bool        // the trigger is muted and does not fire
+	scan   int         // offset in buf where the next scan starts
+
+	lineTimer *time.Timer // for -line-timeout
+	lineGen   int         // incremented to cancel lineTimer
+
+	filters []lineFilter // if not empty, filters applied to input lines
+	partial []byte       // an incomplete line held back from filtering
+
+	more     [][]int // additional matches found on the current line
+	moreText string  // the text of the current line
+	moreAt   int64   // the offset of the current line
+
+	offset  int64  // the input offset of the start of buf
+	ctx     []byte // recently consumed input, for -pipe-context
+	ctxLast int    // the length of the latest data consumed, at the end of ctx
+	matchAt int64  // the input offset of the most recent match
+
+	gaps []cutGap // input cut from buf by -keep-prefix, in order of position
+
+	lastM    []int  // the most recent match, for -last
+	lastText string // the text of the most recent match, for -last
+	lastAt   int64  // the offset of the most recent match, for -last
+
+	numChecks []numCheck // thresholds from -num-gt and -num-lt
+
+	seen  map[string]bool // values of the -distinct submatch already fired
+	seenQ []string        // seen values in order of arrival, for eviction
+
+	run   []string // the current run of matching lines, for -collapse
+	runAt int64    // the offset of the first match in run
+
+	batched    []string    // the matches of the current -batch
+	batchAt    int64       // the offset of the first match in batched
+	batchTimer *time.Timer // for -batch-timeout
+	batchGen   int         // incremented to cancel batchTimer
+
+	lineFile string // the name of the input file being read, for -gnu-format and -template
+	lineNo   int    // the number of the current line of lineFile
+
+	counts map[string]int // match counts by value of the -count-by submatch
+}
+
+// A matchBuffer holds input for a trigger to search for matches.  A private
+// buffer for a single trigger is a *bytes.Buffer.
+type matchBuffer interface {
+	io.Writer
+	Bytes() []byte
+	Len() int
+	Next(n int) []byte
+}
+
+// describe returns a human-readable summary of the trigger configuration.
+func (t *trigger) describe() string {
+	return fmt.Sprintf("pattern=%q command=%s line=%v pipe=%v literal=%v anchored=%v",
+		t.re, t.cmd, !t.multi, t.isPipe, t.lit != nil, t.anchored)
+}
+
+// hasMatch reports whether the buffer currently contains a match for the
+// pattern, and if so returns the matching indices and the prefix of the buffer
+// containing the match. The caller must hold t.mu.
+//
+// If closing == true, a line match will be attempted even if the buffer does
+// not contain a newline.
+func (t *trigger) hasMatch(closing bool) ([]int, string, bool) {
+	if t.multi && *maxLines > 0 {
+		return t.hasLinesMatch()
+	} else if t.multi {
+		// Check for a match of the regexp.
+		m := t.find(t.buf.Bytes()[t.scan:])
+		if m == nil {
+			// Discard data in excess of the buffer size limit.
+			n := t.trim()
+			t.scan = max(0, t.scan-n)
+			if *winMatch && !t.anchored {
+				t.scan = t.windowStart()
+			}
+			return nil, "", false
+		}
+		for i, pos := range m {
+			if pos >= 0 {
+				m[i] = pos + t.scan
+			}
+		}
+		t.scan = 0
+		t.matchAt = t.inputOffset(m[0])
+		if t.keepPrefix && 0 < m[0] && m[0] < m[1] {
+			return m, t.cut(m), true
+		}
+		return m, string(t.next(m[1])), true
+	}
+
+	// Report any further matches remaining from the previous line.
+	if len(t.more) != 0 {
+		m := t.more[0]
+		t.more = t.more[1:]
+		t.matchAt = t.moreAt + int64(m[0])
+		return m, t.moreText, true
+	}
+
+	// Scan ahead line-by-line, looking for a match.
+	for t.buf.Len() > 0 {
+		line, lineAt, ok := t.nextLine(closing)
+		if !ok {
+			break
+		}
+		if (gnuOut != nil || tmplOut != nil) && !t.onPaths {
+			t.countLine()
+		}
+		if *matchLimit == 1 || t.collapse {
+			if m := t.find(line); m != nil {
+				t.matchAt = lineAt + int64(m[0])
+				return m, string(line), true
+			}
+			t.endRun() // a non-matching line ends a -collapse run
+		} else if ms := t.findAll(line, *matchLimit); len(ms) != 0 {
+			text := string(line)
+			t.more, t.moreText, t.moreAt = ms[1:], text, lineAt
+			t.matchAt = lineAt + int64(ms[0][0])
+			return ms[0], text, true
+		}
+
+		// No match on this line, but see if there are more
+	}
+	return nil, "", false
+}
+
+// hasLinesMatch implements hasMatch for a multi-line trigger when matches are
+// limited to -multi-max-lines lines. The caller must hold t.mu.
+//
+// Matches are sought within the first lines of the buffer. If the buffer holds
+// at least that many complete lines with no match among them, the first line
+// is discarded and the search moves ahead.
+func (t *trigger) hasLinesMatch() ([]int, string, bool) {
+	for {
+		buf := t.buf.Bytes()
+		end, nl := 0, 0
+		for nl < *maxLines {
+			i := bytes.IndexByte(buf[end:], '\n')
+			if i < 0 {
+				break
+			}
+			end += i + 1
+			nl++
+		}
+		if nl < *maxLines {
+			end = len(buf) // all we have so far
+		}
+		if m := t.find(buf[:end]); m != nil {
+			t.matchAt = t.inputOffset(m[0])
+			return m, string(t.next(m[1])), true
+		} else if nl < *maxLines {
+			// Wait for more lines, but do not exceed the buffer size limit.
+			t.trim()
+			return nil, "", false
+		}
+		t.next(bytes.IndexByte(buf, '\n') + 1)
+	}
+}
+
+// cut removes the match m from the buffer, but keeps the input before it to be
+// matched again, for -keep-prefix. It returns the text of the match, including
+// the input before it, as if it had been consumed. The caller must hold t.mu.
+func (t *trigger) cut(m []int) string {
+	buf := t.buf.(*bytes.Buffer) // -keep-prefix buffers are never shared
+	data := buf.Bytes()
+	text := string(data[:m[1]])
+	rest := append([]byte(text[:m[0]]), data[m[1]:]...)
+	buf.Reset()
+	buf.Write(rest)
+
+	// Record the gap, so that the data after it keep their input offsets.
+	// Earlier gaps within the match are merged into it.
+	size := m[1] - m[0]
+	gaps := make([]cutGap, 0, len(t.gaps)+1)
+	n := int64(size)
+	for _, g := range t.gaps {
+		if g.at <= m[0] {
+			gaps = append(gaps, g)
+		} else if g.at <= m[1] {
+			n += g.n
+		}
+	}
+	gaps = append(gaps, cutGap{at: m[0], n: n})
+	for _, g := range t.gaps {
+		if g.at > m[1] {
+			gaps = append(gaps, cutGap{at: g.at - size, n: g.n})
+		}
+	}
+	t.gaps = gaps
+	return text
+}
+
+// A cutGap records that n bytes of input were cut from the buffer before
+// position at, for -keep-prefix.
+type cutGap struct {
+	at int
+	n  int64
+}
+
+// inputOffset returns the input offset of position i in the buffer, which
+// differs from t.offset+i if -keep-prefix has cut input before i. The caller
+// must hold t.mu.
+func (t *trigger) inputOffset(i int) int64 {
+	pos := t.offset + int64(i)
+	for _, g := range t.gaps {
+		if g.at > i {
+			break
+		}
+		pos += g.n
+	}
+	return pos
+}
+
+// nextLine consumes and returns the next complete line of the buffer, without
+// its newline, and its input offset. With -paragraph, it returns the next
+// record instead. If closing == true, an incomplete final line is returned.
+// It reports false if there is no complete line.
+func (t *trigger) nextLine(closing bool) ([]byte, int64, bool) {
+	if *paragraph {
+		return t.nextRecord(closing)
+	}
+	at := t.offset
+
+	// Bytes before t.scan were already checked for a newline, so we do not
+	// need to search them again. A line is split only once it is known to be
+	// longer than n bytes; a line of exactly n bytes may be awaiting its newline.
+	i := bytes.IndexByte(t.buf.Bytes()[t.scan:], '\n')
+	if n := *maxLineLen; n > 0 && (i < 0 && t.buf.Len() > n || i >= 0 && t.scan+i > n) {
+		t.scan = 0
+		return t.next(n), at, true // a long line is matched in pieces
+	} else if i >= 0 {
+		end := t.scan + i
+		t.scan = 0
+		return t.next(end + 1)[:end], at, true
+	} else if closing {
+		t.scan = 0
+		return t.next(t.buf.Len()), at, true
+	}
+	t.scan = t.buf.Len()
+	return nil, 0, false
+}
+
+// nextRecord consumes and returns the next record of the buffer for
+// -paragraph, and its input offset. A record ends at a blank line, and does
+// not include the blank lines or the newline that ends its last line.
+func (t *trigger) nextRecord(closing bool) ([]byte, int64, bool) {
+	// Blank lines before a record do not belong to it.
+	buf := t.buf.Bytes()
+	if n := len(buf) - len(bytes.TrimLeft(buf, "\n")); n > 0 {
+		t.next(n)
+		t.scan = max(0, t.scan-n)
+		buf = t.buf.Bytes()
+	}
+	if len(buf) == 0 {
+		return nil, 0, false
+	}
+	at := t.offset
+	i := bytes.Index(buf[t.scan:], []byte("\n\n"))
+	if n := *maxLineLen; n > 0 && (i < 0 && len(bytes.TrimSuffix(buf, []byte("\n"))) > n || i >= 0 && t.scan+i > n) {
+		t.scan = 0
+		return t.next(n), at, true // a long record is matched in pieces
+	} else if i >= 0 {
+		end := t.scan + i
+		t.scan = 0
+		return t.next(end + 2)[:end], at, true
+	} else if closing {
+		t.scan = 0
+		return bytes.TrimSuffix(t.next(len(buf)), []byte("\n")), at, true
+	}
+	t.scan = max(0, len(buf)-1) // the separator may span the next block
+	return nil, 0, false
+}
+
+// trim discards the oldest data in the buffer in excess of the buffer size
+// limit, and returns the number of bytes discarded. With -buf-overlap, the cut
+// is moved back to the start of the line it falls in (or the start of the
+// buffer), if that is at most -buf-overlap bytes earlier, so that a match
+// beginning at the start of that line is not truncated. The caller must hold
+// t.mu.
+func (t *trigger) trim() int {
+	n := t.buf.Len() - *bufLimit
+	if n <= 0 {
+		return 0
+	}
+	if *bufOverlap > 0 {
+		lo := max(0, n-*bufOverlap)
+		if i := bytes.LastIndexByte(t.buf.Bytes()[lo:n], '\n'); i >= 0 {
+			n = lo + i + 1
+		} else if lo == 0 {
+			return 0 // keep the line at the start of the buffer
+		}
+	}
+	t.next(n)
+	return n
+}
+
+// next consumes and returns the next n bytes of the buffer, keeping track of
+// the input offset. The caller must hold t.mu.
+func (t *trigger) next(n int) []byte {
+	t.offset = t.inputOffset(n)
+	if len(t.gaps) != 0 {
+		gaps := t.gaps[:0]
+		for _, g := range t.gaps {
+			if g.at > n {
+				gaps = append(gaps, cutGap{at: g.at - n, n: g.n})
+			}
+		}
+		t.gaps = gaps
+	}
+	data := t.buf.Next(n)
+	if t.pipeContext > 0 {
+		// Keep enough to give the context before the latest data.
+		t.ctx = append(t.ctx, data...)
+		if extra := len(t.ctx) - t.pipeContext - len(data); extra > 0 {
+			t.ctx = t.ctx[extra:]
+		}
+		t.ctxLast = len(data)
+	}
+	return data
+}
+
+// context returns up to -pipe-context bytes of the input preceding the data
+// most recently consumed from the buffer. The caller must hold t.mu.
+func (t *trigger) context() string {
+	before := t.ctx[:len(t.ctx)-t.ctxLast]
+	return string(before[max(0, len(before)-t.pipeContext):])
+}
+
+// foldASCII rewrites re to match input in which ASCII letters have been
+// converted to lower case: upper-case ASCII letters in literals and character
+// classes are replaced by their lower-case equivalents.
+func foldASCII(re *syntax.Regexp) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for i, r := range re.Rune {
+			if 'A' <= r && r <= 'Z' {
+				re.Rune[i] = r + 'a' - 'A'
+			}
+		}
+	case syntax.OpCharClass:
+		if isNegated(re.Rune) {
+			// A negated class such as [^a] must exclude a lower-case letter
+			// unless it includes both cases.
+			var out []rune
+			for i := 0; i+1 < len(re.Rune); i += 2 {
+				lo, hi := re.Rune[i], re.Rune[i+1]
+				for r := max(lo, 'a'); r <= min(hi, 'z'); r++ {
+					if !inClass(re.Rune, r+'A'-'a') {
+						if lo < r {
+							out = append(out, lo, r-1)
+						}
+						lo = r + 1
+					}
+				}
+				if lo <= hi {
+					out = append(out, lo, hi)
+				}
+			}
+			re.Rune = out
+			break
+		}
+
+		// Add the lower-case equivalent of each upper-case range. The
+		// class is put back in order when the pattern is parsed again.
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := max(re.Rune[i], 'A'), min(re.Rune[i+1], 'Z')
+			if lo <= hi {
+				re.Rune = append(re.Rune, lo+'a'-'A', hi+'a'-'A')
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		foldASCII(sub)
+	}
+}
+
+// isNegated reports whether the class with the given ranges was written as a
+// negated class, such as [^a]. The parser does not record this, so like
+// syntax.Regexp.String, we treat a class as negated if it includes both the
+// first and the last rune.
+func isNegated(ranges []rune) bool {
+	return len(ranges) != 0 && ranges[0] == 0 && ranges[len(ranges)-1] == utf8.MaxRune
+}
+
+// inClass reports whether r is in one of the given ranges.
+func inClass(ranges []rune, r rune) bool {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i] <= r && r <= ranges[i+1] {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerASCII returns a copy of data with ASCII letters converted to lower
+// case. Other bytes, including those of non-ASCII UTF-8 sequences, are not
+// modified, so offsets in the copy are the same as in data.
+func lowerASCII(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, c := range data {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// find returns the indices of the leftmost match of the pattern in data and
+// its submatches, or nil if there is no match.
+//
+// If the trigger is anchored, only a match at the start of data is reported.
+// Since the leftmost match is found, there is an anchored match if and only if
+// the leftmost match begins at offset 0.
+func (t *trigger) find(data []byte) []int {
+	if t.asciiFold {
+		data = lowerASCII(data)
+	}
+	var m []int
+	if t.lit == nil {
+		m = t.re.FindSubmatchIndex(data)
+	} else if i := bytes.Index(data, t.lit); i >= 0 {
+		m = []int{i, i + len(t.lit)}
+	}
+	if t.anchored && m != nil && m[0] != 0 {
+		return nil
+	}
+	return m
+}
+
+// findAll returns the indices of up to n successive non-overlapping matches
+// of the pattern in data, or all of them if n <= 0.
+func (t *trigger) findAll(data []byte, n int) [][]int {
+	if t.anchored {
+		if m := t.find(data); m != nil {
+			return [][]int{m}
+		}
+		return nil
+	} else if n <= 0 {
+		n = -1
+	}
+	if t.asciiFold {
+		data = lowerASCII(data)
+	}
+	if t.lit == nil {
+		return t.re.FindAllSubmatchIndex(data, n)
+	}
+	var ms [][]int
+	for pos := 0; n < 0 || len(ms) < n; {
+		i := bytes.Index(data[pos:], t.lit)
+		if i < 0 {
+			break
+		}
+		pos += i + len(t.lit)
+		ms = append(ms, []int{pos - len(t.lit), pos})
+	}
+	return ms
+}
+
+// windowStart returns the offset in the buffer where the next multi-line scan
+// should begin, for -window-match. The caller must hold t.mu.
+//
+// The result is at most -window-overlap bytes before the end of the buffer,
+// moved back to the start of a line if there is one after the current scan
+// position, so that line anchors still match correctly.
+func (t *trigger) windowStart() int {
+	buf := t.buf.Bytes()
+	end := len(buf) - *winOverlap
+	if end <= t.scan {
+		return t.scan
+	}
+	if i := bytes.LastIndexByte(buf[t.scan:end], '\n'); i >= 0 {
+		return t.scan + i + 1
+	}
+	return end
+}
+
+// fire starts a subprocess to handle the pattern match x.
+func (t *trigger) fire(x *match) {
+	m, text := x.m, x.text
+	diag("Match pattern=%q indices=%v text=%q", t.re, m, text)
+	if *doVerbose {
+		if names := t.namedSubmatches(m, text); names != "" {
+			diag("Named submatches: %s", names)
+		}
+	}
+
+	if *jitter > 0 {
+		time.Sleep(rand.N(*jitter)) // spread out the load of bursty matches
+	}
+	if t.gunzip != "" {
+		data, err := gunzipValue(t.submatch(t.gunzip, text, m))
+		if err != nil {
+			log.Printf("Trigger %d: skipping match: gunzip %q: %v", t.id, t.gunzip, err)
+			return
+		}
+		x = &match{m: []int{0, len(data)}, text: string(data), count: x.count, seq: x.seq, source: x.source}
+	}
+	x.when = time.Now()
+	if t.cond != nil && !t.checkCond(x) {
+		return
+	} else if !t.fan {
+		t.execute(x)
+		return
+	}
+	for i := 1; 2*i+1 < len(m); i++ {
+		if lo, hi := m[2*i], m[2*i+1]; lo >= 0 && lo < hi {
+			sub := *x
+			sub.m = []int{lo, hi}
+			t.execute(&sub)
+		}
+	}
+}
+
+// execute runs the command or webhook of the trigger for the match x.
+func (t *trigger) execute(x *match) {
+	m, text := x.m, x.text
+	if t.webhook != "" {
+		if err := t.post(x); err != nil {
+			log.Printf("Error: webhook %q: %v", t.webhook, err)
+			t.failed(err)
+		}
+		return
+	}
+	if t.coproc != nil {
+		if err := t.coproc.send(t.flattened(text)); err != nil {
+			log.Printf("Error: writing to %q: %v", t.cmd, err)
+			t.failed(err)
+		}
+		return
+	}
+
+	// Substitute any submatches into the command line.
+	var args []string
+	for _, arg := range t.args {
+		args = append(args, t.expand(arg, x))
+	}
+	diag("Running command: %s %s", t.cmd, shell.Join(args))
+
+	proc := t.command(args)
+	proc.Env = t.environ(x)
+	proc.Stdout = cmdOutput
+	if outFiles != nil {
+		path, err := t.expandPath(*cmdOutFile, x)
+		if err != nil {
+			log.Printf("Error: command output: %v", err)
+			return
+		}
+		of, err := outFiles.open(path)
+		if err != nil {
+			log.Printf("Error: command output: %v", err)
+			return
+		}
+		defer outFiles.release(of)
+		proc.Stdout = of.w
+	}
+	if *maxCmdOut > 0 {
+		proc.Stdout = &limitWriter{w: proc.Stdout, n: *maxCmdOut}
+	}
+	proc.Stderr = cmdErrors
+	if *errToOut {
+		proc.Stderr = proc.Stdout
+	}
+	if *mergeOut {
+		// Use a single writer, so that exec copies both in one goroutine.
+		var w io.Writer = stdout
+		if *maxCmdOut > 0 {
+			w = &limitWriter{w: w, n: *maxCmdOut}
+		}
+		proc.Stdout, proc.Stderr = w, w
+	}
+	var inPath string
+	if t.pipeFile != "" {
+		inPath = t.submatch(t.pipeFile, text, m)
+	} else if t.isPipe {
+		proc.Stdin = t.pipeInput(strings.NewReader(x.context + t.pipeText(x)))
+	} else {
+		inPath = *cmdStdin
+	}
+	if inPath != "" {
+		f, err := os.Open(inPath)
+		if err != nil {
+			log.Printf("Error: reading input for %q: %v", t.cmd, err)
+			return
+		}
+		defer f.Close()
+		proc.Stdin = f
+		if t.isPipe {
+			proc.Stdin = t.pipeInput(f)
+		}
+	}
+	if cmdLock != nil {
+		if err := cmdLock.lock(); err != nil {
+			log.Printf("Error: locking -lockfile: %v", err)
+			return
+		}
+	}
+	err := t.runProc(proc)
+	if cmdLock != nil {
+		if err := cmdLock.unlock(); err != nil {
+			log.Printf("Error: unlocking -lockfile: %v", err)
+		}
+	}
+	if exitLog != nil {
+		t.logExit(x, args, err)
+	}
+	if isMissing(err) {
+		t.disable(err)
+	} else if err != nil {
+		t.logFailure(err)
+	}
+	if err != nil {
+		t.failed(err)
+	}
+}
+
+// pipeText returns the text to pipe to the command for the match x: the match
+// text, or for a ":::command" each numbered submatch on a line of its own.
+func (t *trigger) pipeText(x *match) string {
+	if !t.subsIn {
+		return t.flattened(x.text)
+	}
+	var sb strings.Builder
+	for i := 1; i <= t.re.NumSubexp(); i++ {
+		sb.WriteString(t.flattened(t.submatch(strconv.Itoa(i), x.text, x.m)))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// flattened returns s with each newline replaced by -flatten-sep, if -flatten
+// is set, or s unchanged otherwise.
+func (t *trigger) flattened(s string) string {
+	if !t.flatten {
+		return s
+	}
+	return strings.ReplaceAll(s, "\n", t.flattenSep)
+}
+
+// pipeInput returns a reader for the piped input r of a command, wrapped with
+// the -pipe-prefix and -pipe-suffix text if they are set.
+func (t *trigger) pipeInput(r io.Reader) io.Reader {
+	if t.pipePrefix == "" && t.pipeSuffix == "" {
+		return r
+	}
+	return io.MultiReader(strings.NewReader(t.pipePrefix), r, strings.NewReader(t.pipeSuffix))
+}
+
+// logExit writes a record to the -exit-log file for a command run with args
+// for the match x, which finished with err, and flushes it so that the log is
+// current while the program runs. Each record gives the time of
+// firing, the trigger number, the exit status, and the command line,
+// separated by tabs. The exit status is -1 if the command could not be run or
+// was killed by a signal.
+func (t *trigger) logExit(x *match, args []string, err error) {
+	code := 0
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		code = ee.ExitCode()
+	} else if err != nil {
+		code = -1
+	}
+	cmdline := shell.Join(append([]string{t.cmd}, args...))
+	rec := fmt.Sprintf("%s\t%d\t%d\t%s\n", x.when.Format(time.RFC3339), t.id, code, cmdline)
+	if _, err := exitLog.Write([]byte(rec)); err != nil {
+		log.Printf("Error: writing -exit-log: %v", err)
+	} else if err := exitLog.flush(); err != nil {
+		log.Printf("Error: writing -exit-log: %v", err)
+	}
+}
+
+// scriptPath returns the absolute path of the script file name, for a command
+// given as "@name". The file must exist, and must be executable unless -interp
+// is set.
+func scriptPath(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("missing file name after @")
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	} else if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%q is not a regular file", name)
+	} else if *interp == "" && fi.Mode()&0111 == 0 {
+		return "", fmt.Errorf("%q is not executable (use -interp to run it)", name)
+	}
+	return filepath.Abs(name)
+}
+
+// command returns a command to run the trigger's command with args. With
+// -interp, the trigger's command is passed as an argument to the interpreter.
+func (t *trigger) command(args []string) *exec.Cmd {
+	if *interp != "" {
+		return exec.Command(*interp, append([]string{t.cmd}, args...)...)
+	}
+	return exec.Command(t.cmd, args...)
+}
+
+// prepareProc applies the -exec-user and -exec-umask settings to proc.
+func prepareProc(proc *exec.Cmd) error {
+	proc.SysProcAttr = procAttr
+	if *execUmask != "" {
+		return withUmask(proc, *execUmask)
+	}
+	return nil
+}
+
+// A runner runs the command name with the given arguments and standard input,
+// and reports its error if any. A trigger with a runner uses it to run its
+// commands instead of starting a process, so that tests can intercept them.
+type runner func(name string, args []string, stdin io.Reader) error
+
+// runProc starts proc and waits for it to exit, recording it as the running
+// command so that Close can kill it. If the trigger has a runner, the command
+// is passed to it instead.
+func (t *trigger) runProc(proc *exec.Cmd) error {
+	if t.runner != nil {
+		return t.runner(proc.Args[0], proc.Args[1:], proc.Stdin)
+	}
+	if err := prepareProc(proc); err != nil {
+		return err
+	}
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	t.running.Store(proc)
+	defer t.running.Store(nil)
+	return proc.Wait()
+}
+
+// logFailure logs that the trigger's command failed with err. With
+// -error-every, only the first failure in each interval is logged, and the
+// number of others is summarized with the next one logged (or at Close).
+func (t *trigger) logFailure(err error) {
+	t.failMu.Lock()
+	defer t.failMu.Unlock()
+	now := time.Now()
+	if *errorEvery > 0 && !t.lastFailLog.IsZero() && now.Sub(t.lastFailLog) < *errorEvery {
+		t.nfail++
+		return
+	}
+	if t.nfail > 0 {
+		log.Printf("Error: executing %q: %v (and %d other failures since %s)",
+			t.cmd, err, t.nfail, t.lastFailLog.Format(time.TimeOnly))
+	} else {
+		log.Printf("Error: executing %q: %v", t.cmd, err)
+	}
+	t.lastFailLog, t.nfail = now, 0
+}
+
+// flushFailures logs a summary of any command failures not yet reported by
+// logFailure.
+func (t *trigger) flushFailures() {
+	t.failMu.Lock()
+	defer t.failMu.Unlock()
+	if t.nfail > 0 {
+		log.Printf("Error: command %q failed %d more times since %s", t.cmd, t.nfail, t.lastFailLog.Format(time.TimeOnly))
+		t.nfail = 0
+	}
+}
+
+// failed records that a firing of the trigger failed with err. If -fail-fast
+// is set, this stops input processing.
+func (t *trigger) failed(err error) {
+	for code := int32(t.failExit); code > 0; {
+		old := failStatus.Load()
+		if old >= code || failStatus.CompareAndSwap(old, code) {
+			break
+		}
+	}
+	if !*failFast {
+		return
+	}
+	code := 1
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() > 0 {
+		code = ee.ExitCode()
+	}
+	exitStatus.CompareAndSwap(0, int32(code))
+	stopInput(fmt.Sprintf("trigger %d failed", t.id))
+}
+
+// namedSubmatches returns a human-readable list of the named submatches of m
+// in text and their values, or "" if the pattern has no named submatches.
+func (t *trigger) namedSubmatches(m []int, text string) string {
+	var parts []string
+	for i, name := range t.re.SubexpNames() {
+		if name == "" {
+			continue
+		} else if 2*i+1 < len(m) && m[2*i] >= 0 {
+			parts = append(parts, fmt.Sprintf("%s=%q", name, text[m[2*i]:m[2*i+1]]))
+		} else {
+			parts = append(parts, name+"=<unmatched>")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// checkCond runs the -if predicate command for a match, and reports whether
+// it succeeded. The output of the predicate is discarded, but its error
+// output is kept.
+func (t *trigger) checkCond(x *match) bool {
+	var args []string
+	for _, arg := range t.cond {
+		args = append(args, t.expand(arg, x))
+	}
+	diag("Running predicate: %s", shell.Join(args))
+	proc := exec.Command(args[0], args[1:]...)
+	proc.Env = t.environ(x)
+	proc.Stderr = cmdErrors
+	if err := t.runProc(proc); err != nil {
+		diag("Predicate failed, not firing: %v", err)
+		return false
+	}
+	return true
+}
+
+// disable marks the trigger as unable to run its command, so that it will not
+// fire again. It logs err the first time the trigger is disabled.
+func (t *trigger) disable(err error) {
+	if t.disabled.CompareAndSwap(false, true) {
+		log.Printf("Error: %v; trigger for %q is disabled", err, t.cmd)
+	}
+}
+
+// isMissing reports whether err indicates that a command could not be run
+// because it does not exist or is not executable.
+func isMissing(err error) bool {
+	return errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission)
+}
+
+// Write implements the io.Writer interface.  Data are copied into the internal
+// buffer, and if this results in a match the trigger is fired in a goroutine.
+func (t *trigger) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	nw, err := t.feed(data, false)
+	for t.dispatch(false) { // not closing
+	}
+	if *lineWait > 0 && !t.multi {
+		t.armLineTimer()
+	}
+	t.account()
+	t.mu.Unlock()
+	return nw, err
+}
+
+// armLineTimer arranges for an incomplete line in the buffer to be matched as
+// if it were complete, if no more input arrives within -line-timeout. Each
+// call supersedes any previous timer. The caller must hold t.mu.
+func (t *trigger) armLineTimer() {
+	t.lineGen++
+	if t.lineTimer != nil {
+		t.lineTimer.Stop()
+	}
+	if t.buf.Len() == 0 && len(t.partial) == 0 {
+		return // nothing is waiting
+	}
+	gen := t.lineGen
+	t.lineTimer = time.AfterFunc(*lineWait, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.lineGen != gen {
+			return // more input arrived, or the trigger closed
+		}
+		diag("Trigger %d: matching incomplete line after %v", t.id, *lineWait)
+		t.feed(nil, true) // flush any held-back input
+		for t.dispatch(true) {
+		}
+		t.account()
+	})
+}
+
+// account reports the number of bytes privately buffered by the trigger to
+// checkMemory. Input held in a shared buffer is accounted for by its owner.
+// The caller must hold t.mu.
+func (t *trigger) account() {
+	n := int64(len(t.partial))
+	if _, ok := t.buf.(*sharedView); !ok {
+		n += int64(t.buf.Len())
+	}
+	checkMemory(n - t.nbuf)
+	t.nbuf = n
+}
+
+// A lineFilter transforms a complete line of input (without its newline)
+// before it is added to a trigger's buffer. If it returns false, the line is
+// discarded.
+type lineFilter func(line []byte) ([]byte, bool)
+
+// inputFilters returns the line filters selected by -since and
+// -valid-utf8-only. They apply to the input of the content triggers, but not
+// to the paths matched by -file-trigger.
+func inputFilters() []lineFilter {
+	var fs []lineFilter
+	if sinceFilter != nil {
+		fs = append(fs, sinceFilter)
+	}
+	if *validUTF8 {
+		fs = append(fs, func(line []byte) ([]byte, bool) {
+			return line, utf8.Valid(line)
+		})
+	}
+	return fs
+}
+
+// feed adds data to the buffer, applying the trigger's line filters if it
+// has any. Filtered input is added to the buffer a line at a time, so an
+// incomplete line is held back until its newline arrives, or until closing.
+// The caller must hold t.mu.
+func (t *trigger) feed(data []byte, closing bool) (int, error) {
+	if len(t.filters) == 0 {
+		return t.buf.Write(data)
+	}
+	t.partial = append(t.partial, data...)
+	for len(t.partial) != 0 {
+		line, rest, ok := bytes.Cut(t.partial, []byte("\n"))
+		if n := *maxLineLen; n > 0 && len(line) > n {
+			line, rest, ok = t.partial[:n], t.partial[n:], false
+		} else if !ok && !closing {
+			break
+		}
+		t.partial = rest
+		if line, keep := t.filter(line); keep {
+			t.buf.Write(line)
+			if ok {
+				t.buf.Write([]byte("\n"))
+			}
+		}
+	}
+	return len(data), nil
+}
+
+// filter applies the trigger's line filters to line, and reports whether the
+// result should be kept.
+func (t *trigger) filter(line []byte) ([]byte, bool) {
+	for _, f := range t.filters {
+		var keep bool
+		if line, keep = f(line); !keep {
+			return nil, false
+		}
+	}
+	return line, true
+}
+
+// gunzipValue decompresses s, which is gzip data or gzip data encoded in
+// base64, for -gunzip-capture.
+func gunzipValue(s string) ([]byte, error) {
+	data := []byte(s)
+	if !bytes.HasPrefix(data, []byte("\x1f\x8b")) { // not raw gzip
+		dec, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("not gzip or base64 data")
+		}
+		data = dec
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// decodeFilter returns a lineFilter that decodes each line from the named
+// encoding, discarding lines that cannot be decoded.
+func decodeFilter(name string) (lineFilter, error) {
+	var dec func(string) ([]byte, error)
+	switch name {
+	case "base64":
+		dec = func(s string) ([]byte, error) {
+			return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+		}
+	case "hex":
+		dec = hex.DecodeString
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	return func(line []byte) ([]byte, bool) {
+		out, err := dec(string(bytes.TrimSpace(line)))
+		if err != nil {
+			diag("Skipping line that is not valid %s: %v", name, err)
+			return nil, false
+		}
+		return out, true
+	}, nil
+}
+
+// dispatch reports whether there is a match in the buffer, and if so
+// dispatches a subprocess to handle it.  The caller must hold t.mu.
+func (t *trigger) dispatch(closing bool) bool {
+	m, text, ok := t.hasMatch(closing)
+	if !ok {
+		return false
+	}
+	nmatches.Add(1)
+	if gnuOut != nil && !t.onPaths {
+		t.locate(m, text)
+	}
+	if t.countBy != "" {
+		t.count(t.submatch(t.countBy, text, m))
+	}
+	if t.disabled.Load() || t.muted {
+		return true // consume the match, but do not fire
+	} else if *maxFires > 0 && t.nfired >= *maxFires {
+		return true // consume the match, but do not fire
+	} else if t.done {
+		return true // already fired, for -once
+	} else if !t.checkNumbers(m, text) {
+		return true // outside the -num-gt or -num-lt threshold
+	} else if t.distinct != "" && !t.markSeen(t.distinctKey(m, text)) {
+		return true // already fired for this value
+	} else if t.last {
+		t.lastM, t.lastText, t.lastAt = m, text, t.matchAt // save it for Close
+		return true
+	} else if t.collapse {
+		if len(t.run) == 0 {
+			t.runAt = t.matchAt
+		}
+		t.run = append(t.run, text) // fire when the run ends
+		return true
+	} else if t.batch > 1 {
+		t.addBatch(text[m[0]:m[1]])
+		return true
+	}
+	t.launch(m, text, 1)
+	return true
+}
+
+// endRun fires once for the run of matching lines saved by a -collapse
+// trigger, if there is one. The caller must hold t.mu.
+func (t *trigger) endRun() {
+	if len(t.run) == 0 {
+		return
+	}
+	text := strings.Join(t.run, "\n")
+	t.matchAt = t.runAt
+	t.launch([]int{0, len(text)}, text, len(t.run))
+	t.run = nil
+}
+
+// addBatch adds the match text s to the current -batch, and fires for the
+// batch if it is full. The caller must hold t.mu.
+func (t *trigger) addBatch(s string) {
+	if len(t.batched) == 0 {
+		t.batchAt = t.matchAt
+	}
+	t.batched = append(t.batched, s)
+	if len(t.batched) >= t.batch {
+		t.endBatch()
+		return
+	} else if len(t.batched) > 1 || t.batchWait <= 0 {
+		return
+	}
+	gen := t.batchGen
+	t.batchTimer = time.AfterFunc(t.batchWait, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.batchGen != gen {
+			return // the batch was already fired
+		}
+		diag("Trigger %d: firing partial batch after %v", t.id, t.batchWait)
+		t.endBatch()
+	})
+}
+
+// endBatch fires once for the matches saved by a -batch trigger, if there
+// are any. The caller must hold t.mu.
+func (t *trigger) endBatch() {
+	t.batchGen++
+	if t.batchTimer != nil {
+		t.batchTimer.Stop()
+		t.batchTimer = nil
+	}
+	if len(t.batched) == 0 {
+		return
+	}
+	text := strings.Join(t.batched, "\n")
+	t.matchAt = t.batchAt
+	t.launch([]int{0, len(text)}, text, len(t.batched))
+	t.batched = nil
+}
+
+// launch fires the trigger for the match m in text, standing for count
+// matches, or defers it for -sort-output. The caller must hold t.mu.
+func (t *trigger) launch(m []int, text string, count int) {
+	t.done = t.once
+	x := &match{m: m, text: text, count: count, source: inputName(), offset: t.matchAt}
+	if !t.multi {
+		x.line = t.lineNo
+	}
+	if t.pipeContext > 0 {
+		x.context = t.context()
+	}
+	if sorted.hold(t, x) {
+		return // fire in order of position at the end of input
+	}
+	t.launchMatch(x)
+}
+
+// launchMatch records a firing of the trigger for x, and starts a subprocess
+// to handle it. The caller must hold t.mu.
+func (t *trigger) launchMatch(x *match) {
+	m, text := x.m, x.text
+	x.seq = nseq.Add(1)
+	t.nfired++
+	if t.nfired == *maxFires && t.capped != nil {
+		t.capped()
+	}
+	if extractOut != nil {
+		t.extract(m, text)
+	}
+	if csvOut != nil {
+		if err := csvOut.record(t, m, text); err != nil {
+			log.Printf("Error: writing -csv: %v", err)
+		}
+	}
+	if tmplOut != nil {
+		if err := tmplOut.record(t, x); err != nil {
+			log.Printf("Error: writing -template: %v", err)
+		}
+	}
+	if t.cmd == "" && t.webhook == "" {
+		return // nothing to run
+	} else if t.replaceCmd {
+		return // the command is run when the output is written
+	}
+	run := func() {
+		t.fire(x)
+		<-t.sync
+	}
+	switch t.onBusy {
+	case "drop":
+		select {
+		case t.sync <- struct{}{}:
+		default:
+			t.ndropped++
+			log.Printf("Trigger %d: command busy; dropped match %q (%d dropped)", t.id, text[m[0]:m[1]], t.ndropped)
+			return
+		}
+	case "queue":
+		t.enqueue(run)
+		return
+	default:
+		t.sync <- struct{}{}
+	}
+	t.start(run)
+}
+
+// start runs a firing of the trigger, which must hold t.sync.
+func (t *trigger) start(run func()) {
+	if *syncFire {
+		run() // in the caller, for -sync-fire
+	} else if serialQueue != nil {
+		serialQueue <- run
+	} else {
+		go run()
+	}
+}
+
+// enqueue adds run to the queue of pending firings, for -on-busy=queue. The
+// firings are started in order, each once the previous one has finished,
+// without blocking the caller.
+func (t *trigger) enqueue(run func()) {
+	t.qmu.Lock()
+	defer t.qmu.Unlock()
+	t.queue = append(t.queue, run)
+	t.pending.Add(1)
+	if t.draining {
+		return // the worker is already running
+	}
+	t.draining = true
+	go func() {
+		for {
+			t.qmu.Lock()
+			if len(t.queue) == 0 {
+				t.draining = false
+				t.qmu.Unlock()
+				return
+			}
+			next := t.queue[0]
+			t.queue = t.queue[1:]
+			t.qmu.Unlock()
+
+			t.sync <- struct{}{}
+			t.start(func() {
+				defer t.pending.Done()
+				next()
+			})
+		}
+	}()
+}
+
+// countLine records that the trigger has read another line of the current
+// input file, for -gnu-format and -template. The caller must hold t.mu.
+func (t *trigger) countLine() {
+	if name := inputName(); name != t.lineFile {
+		t.lineFile, t.lineNo = name, 0
+	}
+	t.lineNo++
+}
+
+// locate writes the location of the match m in the current line, text, to the
+// -gnu-format file. Columns are counted in bytes from 1.
+func (t *trigger) locate(m []int, text string) {
+	rec := fmt.Sprintf("%s:%d:%d: %s%c", t.lineFile, t.lineNo, m[0]+1, text[m[0]:m[1]], recordEnd())
+	if _, err := gnuOut.Write([]byte(rec)); err != nil {
+		log.Printf("Error: writing -gnu-format: %v", err)
+	}
+}
+
+// extract writes a JSON object for the submatches of m in text to the -extract
+// file. Each submatch is keyed by its name, or by its index if it is unnamed.
+// Submatches that did not participate in the match are null.
+func (t *trigger) extract(m []int, text string) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range t.re.SubexpNames()[1:] {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if name == "" {
+			name = strconv.Itoa(i + 1)
+		}
+		buf.WriteString(jsonString(name))
+		buf.WriteByte(':')
+		if j := 2 * (i + 1); j+1 < len(m) && m[j] >= 0 {
+			buf.WriteString(jsonString(text[m[j]:m[j+1]]))
+		} else {
+			buf.WriteString("null")
+		}
+	}
+	buf.WriteByte('}')
+	buf.WriteByte(recordEnd())
+	if _, err := extractOut.Write(buf.Bytes()); err != nil {
+		log.Printf("Error: writing -extract: %v", err)
+	}
+}
+
+// recordEnd returns the byte that ends each -extract, -gnu-format, and
+// -template record.
+func recordEnd() byte {
+	if *print0 {
+		return 0
+	}
+	return '\n'
+}
+
+// distinctKey returns the value of the -distinct submatch of m in text,
+// converted to lower case if -distinct-fold is set.
+func (t *trigger) distinctKey(m []int, text string) string {
+	key := t.submatch(t.distinct, text, m)
+	if t.distinctFold {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// A numCheck is a threshold on the numeric value of a submatch, for -num-gt
+// (if gt is true) or -num-lt.
+type numCheck struct {
+	name  string
+	limit float64
+	gt    bool
+}
+
+// checkNumbers reports whether the match m in text satisfies the trigger's
+// numeric thresholds. A submatch that is not a number fails its threshold.
+func (t *trigger) checkNumbers(m []int, text string) bool {
+	for _, c := range t.numChecks {
+		sub := t.submatch(c.name, text, m)
+		v, err := strconv.ParseFloat(sub, 64)
+		if err != nil {
+			diag("Trigger %d: submatch %q is not a number: %q", t.id, c.name, sub)
+			return false
+		} else if (c.gt && !(v > c.limit)) || (!c.gt && !(v < c.limit)) {
+			return false
+		}
 	}
-	t.sync <- struct{}{}
-	go func() {
-		t.fire(m, text)
-		<-t.sync
-	}()
 	return true
 }
 
+// markSeen reports whether val is a new value of the -distinct submatch, and
+// if so records it as seen. If the trigger already remembers -distinct-max
+// values, the oldest is forgotten. The caller must hold t.mu.
+func (t *trigger) markSeen(val string) bool {
+	if t.seen[val] {
+		return false
+	} else if t.seen == nil {
+		t.seen = make(map[string]bool)
+	}
+	if t.distinctMax > 0 && len(t.seenQ) >= t.distinctMax {
+		delete(t.seen, t.seenQ[0])
+		t.seenQ = t.seenQ[1:]
+	}
+	t.seen[val] = true
+	t.seenQ = append(t.seenQ, val)
+	return true
+}
+
+// otherValues is the -count-by key for values beyond -count-max.
+const otherValues = "(other)"
+
+// count records a match with val as the value of the -count-by submatch. Once
+// -count-max values are counted, other new values are counted together. The
+// caller must hold t.mu.
+func (t *trigger) count(val string) {
+	if t.counts == nil {
+		t.counts = make(map[string]int)
+	}
+	if _, ok := t.counts[val]; !ok && t.countMax > 0 && len(t.counts) >= t.countMax {
+		val = otherValues
+	}
+	t.counts[val]++
+}
+
+// printCounts writes the -count-by histogram to stderr, most frequent values
+// first. The caller must hold t.mu.
+func (t *trigger) printCounts() {
+	vals := make([]string, 0, len(t.counts))
+	for val := range t.counts {
+		vals = append(vals, val)
+	}
+	sort.Slice(vals, func(i, j int) bool {
+		if ci, cj := t.counts[vals[i]], t.counts[vals[j]]; ci != cj {
+			return ci > cj
+		}
+		return vals[i] < vals[j]
+	})
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Trigger %d: matches by %s:\n", t.id, t.countBy)
+	for _, val := range vals {
+		fmt.Fprintf(&buf, "%10d %s\n", t.counts[val], val)
+	}
+	os.Stderr.Write(buf.Bytes())
+}
+
+// drain handles any remaining matches in the buffer at the end of the input.
+// The caller must hold t.mu.
+func (t *trigger) drain() {
+	t.lineGen++       // cancel a pending -line-timeout
+	t.feed(nil, true) // flush any held-back input
+
+	for t.dispatch(true) { // closing
+	}
+	t.endRun()
+	t.endBatch()
+	if t.lastM != nil {
+		t.matchAt = t.lastAt
+		t.launch(t.lastM, t.lastText, 1)
+		t.lastM = nil
+	}
+}
+
 // Close implements the io.Closer interface. It handles any remaining matches
 // in the buffer, then waits for all subprocesses to exit.
+//
+// If -close-timeout is set and the subprocesses do not finish in time, Close
+// logs a message and returns without waiting for them. If -close-kill is also
+// set, the running subprocess is killed. The timeout is shared by all the
+// triggers, and counts from when the first of them is closed.
 func (t *trigger) Close() error {
-	t.mu.Lock()
-	for t.dispatch(true) { // closing
+	deadline := closeDeadline()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.mu.Lock()
+		t.drain()
+		if t.countBy != "" {
+			t.printCounts()
+		}
+		t.mu.Unlock()
+		t.pending.Wait()     // wait for queued firings to start (-on-busy=queue)
+		t.sync <- struct{}{} // wait for the last subprocess (if any)
+		t.flushFailures()
+		if t.coproc != nil {
+			if err := t.coproc.stop(); err != nil {
+				log.Printf("Error: executing %q: %v", t.cmd, err)
+			}
+		}
+	}()
+	if *closeWait <= 0 {
+		<-done
+		return nil
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		log.Printf("Trigger %d: command %q did not finish within %v; abandoning it", t.id, t.cmd, *closeWait)
+		if p := t.running.Load(); p != nil && *closeKill {
+			if err := p.Process.Kill(); err != nil {
+				log.Printf("Trigger %d: killing command: %v", t.id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// An outputCache is a bounded cache of open command output files, keyed by
+// path. Files are evicted in least-recently-used order, but a file is not
+// closed while it is in use by a command.
+type outputCache struct {
+	mu    sync.Mutex
+	max   int
+	files map[string]*outputFile
+	lru   *list.List // of *outputFile, most recently used at the front
+}
+
+type outputFile struct {
+	path string
+	f    *os.File
+	w    io.Writer     // f, or a capWriter for -cout-max-size
+	refs int           // number of commands currently using f
+	elt  *list.Element // nil if evicted
+}
+
+func newOutputCache(max int) *outputCache {
+	return &outputCache{max: max, files: make(map[string]*outputFile), lru: list.New()}
+}
+
+// open returns an open file for the specified path, opening it for append if
+// necessary. The caller must release the file when it is no longer in use.
+func (c *outputCache) open(path string) (*outputFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if of, ok := c.files[path]; ok {
+		of.refs++
+		c.lru.MoveToFront(of.elt)
+		return of, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	of := &outputFile{path: path, f: f, w: f, refs: 1}
+	if *coutMax > 0 {
+		size := int64(0)
+		if fi, err := f.Stat(); err == nil {
+			size = fi.Size()
+		}
+		of.w = newCapWriter(f, path, size)
+	}
+	of.elt = c.lru.PushFront(of)
+	c.files[path] = of
+	diag("Opened command output %q", path)
+
+	// Evict the least-recently used files in excess of the limit.
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.max; {
+		prev := e.Prev()
+		c.evict(e.Value.(*outputFile))
+		e = prev
+	}
+	return of, nil
+}
+
+// evict removes of from the cache, and closes its file if it is not in use.
+// The caller must hold c.mu.
+func (c *outputCache) evict(of *outputFile) {
+	c.lru.Remove(of.elt)
+	of.elt = nil
+	delete(c.files, of.path)
+	if of.refs == 0 {
+		c.closeFile(of)
+	}
+}
+
+// release reports that the caller is no longer using of.
+func (c *outputCache) release(of *outputFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	of.refs--
+	if of.refs == 0 && of.elt == nil {
+		c.closeFile(of)
+	}
+}
+
+func (c *outputCache) closeFile(of *outputFile) {
+	if err := of.f.Close(); err != nil {
+		log.Printf("Closing command output %q: %v", of.path, err)
+	}
+}
+
+// closeAll closes all the files in the cache.
+func (c *outputCache) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, of := range c.files {
+		c.evict(of)
+	}
+}
+
+// A sharedInput is an io.Writer that buffers a single copy of its input on
+// behalf of multiple triggers, each of which reads from its own position.
+// Data are retained only until every trigger has consumed them.
+type sharedInput struct {
+	trigs []*trigger
+
+	mu    sync.Mutex
+	data  []byte
+	base  int64 // the input offset of data[0]
+	views []*sharedView
+	nbuf  int64 // len(data), as last reported to checkMemory
+}
+
+// newSharedInput constructs a sharedInput for the given triggers, replacing
+// their private buffers with views of the shared buffer.
+func newSharedInput(trigs []*trigger) *sharedInput {
+	s := &sharedInput{trigs: trigs}
+	for _, t := range trigs {
+		if len(t.filters) != 0 || t.keepPrefix {
+			continue // filtered or -keep-prefix input must be buffered separately
+		}
+		v := &sharedView{s: s}
+		s.views = append(s.views, v)
+		t.buf = v
+	}
+	return s
+}
+
+// Write implements the io.Writer interface. It appends data to the shared
+// buffer, and then gives each trigger an opportunity to match it.
+func (s *sharedInput) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	s.data = append(s.data, data...)
+	s.mu.Unlock()
+	for _, t := range s.trigs {
+		t.Write(data) // the view does not copy the data
+	}
+	s.discard()
+	return len(data), nil
+}
+
+// discard drops data that have been consumed by all the triggers.
+//
+// Data are never modified once written, only sliced away, so a slice returned
+// by a view before the discard remains valid.
+func (s *sharedInput) discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	low := s.base + int64(len(s.data))
+	for _, v := range s.views {
+		low = min(low, v.pos)
+	}
+	s.data = s.data[low-s.base:]
+	s.base = low
+	checkMemory(int64(len(s.data)) - s.nbuf)
+	s.nbuf = int64(len(s.data))
+}
+
+// A sharedView is a matchBuffer for one trigger reading from a sharedInput.
+type sharedView struct {
+	s   *sharedInput
+	pos int64 // the input offset of the next unconsumed byte
+}
+
+// Write reports success without copying, as the shared input already holds
+// the data.
+func (v *sharedView) Write(data []byte) (int, error) { return len(data), nil }
+
+func (v *sharedView) Bytes() []byte {
+	v.s.mu.Lock()
+	defer v.s.mu.Unlock()
+	return v.s.data[v.pos-v.s.base:]
+}
+
+func (v *sharedView) Len() int { return len(v.Bytes()) }
+
+func (v *sharedView) Next(n int) []byte {
+	b := v.Bytes()
+	n = min(n, len(b))
+	v.s.mu.Lock()
+	defer v.s.mu.Unlock()
+	v.pos += int64(n)
+	return b[:n]
+}
+
+// An outputWriter serializes writes to the standard output. If it is
+// buffered, the buffer is flushed periodically, when it is closed, and when
+// the program receives an interrupt or termination signal.
+type outputWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	bw *bufio.Writer // nil if unbuffered
+
+	wrote bool // some output has been written
+	last  byte // the last byte written, if wrote
+
+	stop chan struct{} // closed to stop periodic flushing
+	done chan struct{} // closed when periodic flushing has stopped
+}
+
+// newOutputWriter constructs an outputWriter for w. If size > 0, output is
+// buffered up to that many bytes and flushed at the given interval.
+func newOutputWriter(w io.Writer, size int, interval time.Duration) *outputWriter {
+	o := &outputWriter{w: w}
+	if size <= 0 {
+		return o
+	}
+	o.bw = bufio.NewWriterSize(w, size)
+	o.w = o.bw
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	go o.flushLoop(interval)
+	atInterrupt(func() { o.Flush() })
+	return o
+}
+
+func (o *outputWriter) flushLoop(interval time.Duration) {
+	defer close(o.done)
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-tick:
+			o.Flush()
+		}
+	}
+}
+
+// Write implements the io.Writer interface.
+func (o *outputWriter) Write(data []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	nw, err := o.w.Write(data)
+	if nw > 0 {
+		o.wrote, o.last = true, data[nw-1]
+	}
+	return nw, err
+}
+
+// EnsureNewline writes a newline if any output has been written and it did not
+// end with a newline.
+func (o *outputWriter) EnsureNewline() error {
+	o.mu.Lock()
+	wrote, last := o.wrote, o.last
+	o.mu.Unlock()
+	if !wrote || last == '\n' {
+		return nil
+	}
+	_, err := o.Write([]byte("\n"))
+	return err
+}
+
+// Keepalive writes and flushes text, if no output has been written or the
+// output written so far ends with a newline, so that it does not split a line
+// of the input.
+func (o *outputWriter) Keepalive(text []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.wrote && o.last != '\n' {
+		return nil // in the middle of a line
+	}
+	if _, err := o.w.Write(text); err != nil {
+		return err
+	}
+	o.wrote, o.last = true, text[len(text)-1]
+	if o.bw != nil {
+		return o.bw.Flush()
 	}
-	t.mu.Unlock()
-	t.sync <- struct{}{} // wait for the last subprocess (if any)
 	return nil
 }
+
+// Flush writes any buffered data to the underlying writer.
+func (o *outputWriter) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.bw == nil {
+		return nil
+	}
+	return o.bw.Flush()
+}
+
+// Close stops periodic flushing and flushes any buffered data.
+func (o *outputWriter) Close() error {
+	if o.stop != nil {
+		close(o.stop)
+		<-o.done
+	}
+	return o.Flush()
+}
+
+// A recordFile is an output file to which records may be written
+// concurrently. Output is buffered until the file is closed, or until the
+// program is interrupted.
+type recordFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	closed bool
+}
+
+// openRecordFile opens the file at path for writing records, creating it if
+// necessary. The file is truncated unless mode is os.O_APPEND.
+func openRecordFile(path string, mode int) (*recordFile, error) {
+	if mode != os.O_APPEND {
+		mode = os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|mode, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &recordFile{f: f, w: bufio.NewWriter(f)}
+	atInterrupt(func() { r.flush() })
+	return r, nil
+}
+
+// flush writes any buffered records to the file, unless it is closed.
+func (r *recordFile) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	return r.w.Flush()
+}
+
+// Write implements the io.Writer interface. Each call to Write is atomic with
+// respect to other writes.
+func (r *recordFile) Write(data []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Write(data)
+}
+
+// Close flushes buffered output and closes the file.
+func (r *recordFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	ferr := r.w.Flush()
+	cerr := r.f.Close()
+	return errors.Join(ferr, cerr)
+}
@@ -0,0 +1,847 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/text/transform"
+)
+
+// TestMain runs the program instead of the tests when TEA_TEST_MAIN is set,
+// so that tests can run the program as a subprocess with runTea.
+func TestMain(m *testing.M) {
+	if os.Getenv("TEA_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// teaCommand returns a command to run the program with the given arguments.
+func teaCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "TEA_TEST_MAIN=1")
+	return cmd
+}
+
+// runTea runs the program with the given arguments and standard input, and
+// returns its standard output, its standard error, and its exit status.
+func runTea(t *testing.T, stdin string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	return runCommand(t, teaCommand(args...), strings.NewReader(stdin))
+}
+
+// runCommand runs cmd with the given standard input, and returns its standard
+// output, its standard error, and its exit status.
+func runCommand(t *testing.T, cmd *exec.Cmd, stdin io.Reader) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd.Stdin = stdin
+	var obuf, ebuf bytes.Buffer
+	cmd.Stdout = &obuf
+	cmd.Stderr = &ebuf
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		code = ee.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Running tea: %v", err)
+	}
+	return obuf.String(), ebuf.String(), code
+}
+
+func TestCoutMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file already holds 4 bytes, so only 4 more may be added, and the
+	// existing content must be kept.
+	out, stderr, code := runTea(t, "x\n", "-cout", path, "-cout-max-size", "8", "x", "echo", "hello")
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	if out != "x\n" {
+		t.Errorf("Output: got %q, want %q", out, "x\n")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "old\nhell"; string(got) != want {
+		t.Errorf("Command output: got %q, want %q", got, want)
+	}
+	if !strings.Contains(stderr, "reached -cout-max-size") {
+		t.Errorf("Missing limit message in stderr:\n%s", stderr)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	defer func(n int) { *maxLineLen = n }(*maxLineLen)
+	*maxLineLen = 4
+
+	tests := []struct {
+		input   []string // written to the buffer in turn
+		want    []string // lines returned, in order
+		closing bool     // whether nextLine is closing
+	}{
+		// A line of exactly n bytes is not split before its newline arrives.
+		{[]string{"abcd", "\n"}, []string{"abcd"}, false},
+		{[]string{"abcd\n"}, []string{"abcd"}, false},
+		{[]string{"abcd"}, nil, false},
+		{[]string{"abcd"}, []string{"abcd"}, true},
+
+		// A longer line is split into pieces of n bytes.
+		{[]string{"abcde"}, []string{"abcd"}, false},
+		{[]string{"abcd", "e\n"}, []string{"abcd", "e"}, false},
+		{[]string{"abcdefghi\n"}, []string{"abcd", "efgh", "i"}, false},
+		{[]string{"ab\nabcdef\n"}, []string{"ab", "abcd", "ef"}, false},
+	}
+	for _, tc := range tests {
+		tr := &trigger{buf: bytes.NewBuffer(nil)}
+		var got []string
+		for _, s := range tc.input {
+			tr.buf.Write([]byte(s))
+			for {
+				line, _, ok := tr.nextLine(tc.closing)
+				if !ok || (tc.closing && len(line) == 0 && tr.buf.Len() == 0) {
+					break
+				}
+				got = append(got, string(line))
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("Input %q: got lines %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestParagraphRecords(t *testing.T) {
+	defer func(p bool) { *paragraph = p }(*paragraph)
+	*paragraph = true
+
+	tests := []struct {
+		input   []string // written to the buffer in turn
+		want    []string // offset:record for the records returned, in order
+		closing bool     // whether nextLine is closing
+	}{
+		{[]string{"a\nb\n\nc\n"}, []string{"0:a\nb"}, false},
+		{[]string{"a\nb\n\nc\n"}, []string{"0:a\nb", "5:c"}, true},
+		{[]string{"a"}, nil, false},
+		{[]string{"a"}, []string{"0:a"}, true},
+
+		// Blank lines before and between records are discarded.
+		{[]string{"\n\na\n\nb\n\n"}, []string{"2:a", "5:b"}, false},
+		{[]string{"a\n\n\n\nb\n\n"}, []string{"0:a", "5:b"}, false},
+		{[]string{"\n\n\n"}, nil, true},
+
+		// A separator may span writes.
+		{[]string{"a\n", "\nb\n\n"}, []string{"0:a", "3:b"}, false},
+		{[]string{"a\n\n", "\n\nb"}, []string{"0:a", "5:b"}, true},
+		{[]string{"a", "\n", "\n", "b\n"}, []string{"0:a", "3:b"}, true},
+	}
+	for _, tc := range tests {
+		tr := &trigger{buf: bytes.NewBuffer(nil)}
+		var got []string
+		for i, s := range tc.input {
+			tr.buf.Write([]byte(s))
+			closing := tc.closing && i == len(tc.input)-1
+			for {
+				rec, at, ok := tr.nextLine(closing)
+				if !ok {
+					break
+				}
+				got = append(got, fmt.Sprintf("%d:%s", at, rec))
+			}
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("Input %q: got records %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestCRLFTransformer(t *testing.T) {
+	tests := []struct {
+		src   string
+		atEOF bool
+		want  string // the output
+		nSrc  int    // the number of bytes consumed
+		err   error
+	}{
+		{"", false, "", 0, nil},
+		{"a\r\nb\r\n", false, "a\nb\n", 6, nil},
+		{"a\rb", false, "a\rb", 3, nil},
+		{"\r\r\n", true, "\r\n", 3, nil},
+		{"\n\r", true, "\n\r", 2, nil},
+
+		// A CR at the end of the source must wait for the next byte, unless
+		// it is the end of the input.
+		{"a\r", false, "a", 1, transform.ErrShortSrc},
+		{"a\r", true, "a\r", 2, nil},
+		{"\r", false, "", 0, transform.ErrShortSrc},
+		{"\r", true, "\r", 1, nil},
+		{"a\r\n\r", false, "a\n", 3, transform.ErrShortSrc},
+	}
+	for _, tc := range tests {
+		dst := make([]byte, 16)
+		nDst, nSrc, err := crlfTransformer{}.Transform(dst, []byte(tc.src), tc.atEOF)
+		if got := string(dst[:nDst]); got != tc.want || nSrc != tc.nSrc || err != tc.err {
+			t.Errorf("Transform(%q, atEOF=%v): got %q, %d, %v; want %q, %d, %v",
+				tc.src, tc.atEOF, got, nSrc, err, tc.want, tc.nSrc, tc.err)
+		}
+	}
+
+	// The destination may fill up before the source is consumed.
+	dst := make([]byte, 2)
+	nDst, nSrc, err := crlfTransformer{}.Transform(dst, []byte("a\r\nb"), true)
+	if got := string(dst[:nDst]); got != "a\n" || nSrc != 3 || err != transform.ErrShortDst {
+		t.Errorf("Transform to short buffer: got %q, %d, %v; want %q, 3, %v", got, nSrc, err, "a\n", transform.ErrShortDst)
+	}
+
+	// Reading a byte at a time, every CR is at the end of the source.
+	const input = "a\r\nb\r\r\nc\r"
+	data, err := io.ReadAll(transform.NewReader(iotest.OneByteReader(strings.NewReader(input)), crlfTransformer{}))
+	if err != nil {
+		t.Fatalf("Reading %q: %v", input, err)
+	}
+	if got, want := string(data), "a\nb\r\nc\r"; got != want {
+		t.Errorf("Reading %q: got %q, want %q", input, got, want)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	defer func(n, m int) { *bufLimit, *bufOverlap = n, m }(*bufLimit, *bufOverlap)
+	*bufLimit = 10
+
+	tests := []struct {
+		overlap int
+		input   string
+		want    string // the buffer after trimming
+	}{
+		{0, "0123456789", "0123456789"},
+		{0, "0123456789abc", "3456789abc"},
+		{4, "0123456789", "0123456789"},
+
+		// The cut moves back to the start of the line it falls in.
+		{4, "ab\ncdefghijklm", "cdefghijklm"},
+		{4, "a\nb\ncdefghijklm", "cdefghijklm"},
+
+		// A cut just after a newline does not move.
+		{2, "abcd\nefghijklmn", "efghijklmn"},
+
+		// The cut does not move further back than -buf-overlap, so the line it
+		// falls in is truncated.
+		{1, "ab\ncdefghijklm", "defghijklm"},
+		{4, "abcdefghijklmno", "fghijklmno"},
+
+		// The first line in the buffer is kept if the overlap reaches it.
+		{5, "abcdefghijklmno", "abcdefghijklmno"},
+		{8, "abcdefghijklmno", "abcdefghijklmno"},
+	}
+	for _, tc := range tests {
+		*bufOverlap = tc.overlap
+		tr := &trigger{buf: bytes.NewBuffer(nil)}
+		tr.buf.Write([]byte(tc.input))
+		n := tr.trim()
+		if got := string(tr.buf.Bytes()); got != tc.want || n != len(tc.input)-len(tc.want) {
+			t.Errorf("trim(%q) with overlap %d: got %q (%d cut), want %q", tc.input, tc.overlap, got, n, tc.want)
+		}
+		if tr.offset != int64(n) {
+			t.Errorf("trim(%q) with overlap %d: offset is %d, want %d", tc.input, tc.overlap, tr.offset, n)
+		}
+	}
+}
+
+func TestTrimMidMatch(t *testing.T) {
+	defer func(n, m int) { *bufLimit, *bufOverlap = n, m }(*bufLimit, *bufOverlap)
+	*bufLimit = 12
+
+	// When the buffer is trimmed while a multi-line match is incomplete, the
+	// start of the match is lost unless -buf-overlap keeps its line.
+	for _, tc := range []struct {
+		overlap int
+		want    string
+	}{
+		{0, ""},
+		{8, "BEGIN12345678END"},
+	} {
+		*bufOverlap = tc.overlap
+		tr := parseTriggers(t, []string{`(?ms)BEGIN.*END`, "true"})[0]
+		if !tr.multi {
+			t.Fatalf("Pattern %q is not multi-line", tr.re)
+		}
+		var got string
+		for _, s := range []string{"noise\nBEGIN", "12345678", "END"} {
+			tr.buf.Write([]byte(s))
+			if m, text, ok := tr.hasMatch(false); ok {
+				got = text[m[0]:m[1]]
+				break
+			}
+		}
+		if got != tc.want {
+			t.Errorf("With overlap %d: got match %q, want %q", tc.overlap, got, tc.want)
+		}
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	defer func(n int) { *winOverlap = n }(*winOverlap)
+
+	tests := []struct {
+		input   string
+		scan    int
+		overlap int
+		want    int
+	}{
+		// Without a newline, the window starts -window-overlap bytes before
+		// the end of the buffer.
+		{"abcdefgh", 0, 4, 4},
+		{"abcdefgh", 2, 4, 4},
+
+		// The start moves back to the start of a line.
+		{"ab\ncdefgh", 0, 4, 3},
+		{"abcd\nefgh", 0, 4, 5},
+		{"a\nb\ncdefgh", 0, 4, 4},
+
+		// A newline within the overlap does not move the start forward.
+		{"abcd\nefgh", 0, 5, 4},
+
+		// The start does not move back before the scan position.
+		{"a\nbcdefghij", 3, 4, 7},
+		{"abcdefgh", 6, 4, 6},
+		{"abc", 0, 4, 0},
+		{"abc", 1, 4, 1},
+	}
+	for _, tc := range tests {
+		*winOverlap = tc.overlap
+		tr := &trigger{buf: bytes.NewBuffer([]byte(tc.input)), scan: tc.scan}
+		if got := tr.windowStart(); got != tc.want {
+			t.Errorf("windowStart(%q, scan=%d, overlap=%d): got %d, want %d", tc.input, tc.scan, tc.overlap, got, tc.want)
+		}
+	}
+}
+
+func TestFoldASCII(t *testing.T) {
+	tests := []struct {
+		pattern, input string
+		want           bool
+	}{
+		{"abc", "ABC", true},
+		{"ABC", "abc", true},
+		{"[A-Z]+", "abc", true},
+		{"[a-z]+", "ABC", true},
+		{"[^a]", "a", false},
+		{"[^a]", "A", false},
+		{"[^A]", "a", false},
+		{"[^a]", "b", true},
+		{"[^A-Z]", "q", false},
+		{"[^A-Z]", "Q", false},
+		{"[^A-Z]", "1", true},
+		{"[^aB]", "C", true},
+		{"[^aB]", "b", false},
+		{"[\\W]", "a", false},
+		{"é", "É", false},
+	}
+	for _, tc := range tests {
+		rt, err := syntax.Parse(tc.pattern, syntax.Perl)
+		if err != nil {
+			t.Fatalf("Parse %q: %v", tc.pattern, err)
+		}
+		foldASCII(rt)
+		re := regexp.MustCompile(rt.String())
+		if got := re.Match(lowerASCII([]byte(tc.input))); got != tc.want {
+			t.Errorf("Pattern %q (folded %q) on %q: got %v, want %v", tc.pattern, re, tc.input, got, tc.want)
+		}
+	}
+}
+
+func BenchmarkIgnoreCase(b *testing.B) {
+	const pattern = `error: [^ ]+ failed`
+	input := bytes.Repeat([]byte("Some Log Line With Mixed Case Words\n"), 1000)
+	input = append(input, "ERROR: Frobnicate FAILED\n"...)
+
+	b.Run("Regexp", func(b *testing.B) {
+		re := regexp.MustCompile(`(?i)` + pattern)
+		b.SetBytes(int64(len(input)))
+		for range b.N {
+			if !re.Match(input) {
+				b.Fatal("No match")
+			}
+		}
+	})
+	b.Run("ASCII", func(b *testing.B) {
+		rt, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			b.Fatal(err)
+		}
+		foldASCII(rt)
+		re := regexp.MustCompile(rt.String())
+		b.SetBytes(int64(len(input)))
+		for range b.N {
+			if !re.Match(lowerASCII(input)) {
+				b.Fatal("No match")
+			}
+		}
+	})
+}
+
+// benchInput returns n lines of input for benchmarks, each about width bytes
+// long. None of the lines contains "PANIC".
+func benchInput(n, width int) []byte {
+	var buf bytes.Buffer
+	for i := range n {
+		line := fmt.Sprintf("2026-10-14T12:00:00Z INFO request id=%d latency=%dms path=/api/items ", i, i%997)
+		buf.WriteString(line)
+		for j := len(line); j < width-1; j++ {
+			buf.WriteByte('a' + byte(j%26))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// parseTriggers parses each rule as a trigger, and closes the triggers when
+// tb is finished.
+func parseTriggers(tb testing.TB, rules ...[]string) []*trigger {
+	tb.Helper()
+	var trigs []*trigger
+	for i, rule := range rules {
+		t, err := parseTrigger(rule)
+		if err != nil {
+			tb.Fatalf("Parsing trigger %d: %v", i+1, err)
+		}
+		t.id = i + 1
+		tb.Cleanup(func() { t.Close() })
+		trigs = append(trigs, t)
+	}
+	return trigs
+}
+
+// writeBlocks writes data to w in blocks of the size used by io.Copy.
+func writeBlocks(tb testing.TB, w io.Writer, data []byte) {
+	const blockSize = 32 << 10
+	for len(data) != 0 {
+		n := min(len(data), blockSize)
+		if _, err := w.Write(data[:n]); err != nil {
+			tb.Fatalf("Write: %v", err)
+		}
+		data = data[n:]
+	}
+}
+
+func BenchmarkLineScan(b *testing.B) {
+	for _, width := range []int{100, 10000, 1 << 20} {
+		b.Run(fmt.Sprintf("Width=%d", width), func(b *testing.B) {
+			input := benchInput(max(1, 4<<20/width), width)
+			t := parseTriggers(b, []string{`^PANIC: (\w+)`, "true"})[0]
+			b.SetBytes(int64(len(input)))
+			b.ResetTimer()
+			for range b.N {
+				writeBlocks(b, t, input)
+			}
+		})
+	}
+}
+
+func BenchmarkLiteral(b *testing.B) {
+	input := benchInput(40000, 100)
+	for _, lit := range []bool{true, false} {
+		name := "Regexp"
+		if lit {
+			name = "Literal"
+		}
+		b.Run(name, func(b *testing.B) {
+			t := parseTriggers(b, []string{"PANIC", "true"})[0]
+			if t.lit == nil {
+				b.Fatal("Pattern is not treated as a literal")
+			} else if !lit {
+				t.lit = nil // use the regexp engine
+			}
+			b.SetBytes(int64(len(input)))
+			b.ResetTimer()
+			for range b.N {
+				writeBlocks(b, t, input)
+			}
+		})
+	}
+}
+
+func BenchmarkSharedBuffer(b *testing.B) {
+	const ntrig = 16
+	input := benchInput(4000, 100)
+	for _, shared := range []bool{false, true} {
+		name := "Private"
+		if shared {
+			name = "Shared"
+		}
+		b.Run(name, func(b *testing.B) {
+			var rules [][]string
+			for i := range ntrig {
+				rules = append(rules, []string{fmt.Sprintf(`(?m)^PANIC %d$`, i), "true"})
+			}
+			trigs := parseTriggers(b, rules...)
+			var w io.Writer
+			var buffered func() int
+			if shared {
+				s := newSharedInput(trigs)
+				w = s
+				buffered = func() int { return len(s.data) }
+			} else {
+				var ws []io.Writer
+				for _, t := range trigs {
+					ws = append(ws, t)
+				}
+				w = io.MultiWriter(ws...)
+				buffered = func() int {
+					var n int
+					for _, t := range trigs {
+						n += t.buf.Len()
+					}
+					return n
+				}
+			}
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				writeBlocks(b, w, input)
+			}
+			b.ReportMetric(float64(buffered()), "buffered-bytes")
+		})
+	}
+}
+
+func TestNumThresholds(t *testing.T) {
+	const input = "ms=500\nms=1000\nms=1500\nms=abc\nms=2.5e3\nms=1000.5\nms=-7\nms=3000\n"
+	tests := []struct {
+		opts []string
+		want string
+	}{
+		{[]string{"-num-gt", "ms=1000"}, "1500 2.5e3 1000.5 3000"},
+		{[]string{"-num-lt", "ms=1000"}, "500 -7"},
+		{[]string{"-num-gt", "1=1000", "-num-lt", "ms=3000"}, "1500 2.5e3 1000.5"},
+		{[]string{"-num-gt", "ms=-10", "-num-lt", "ms=0"}, "-7"},
+		{[]string{"-num-gt", "ms=1e9"}, ""},
+	}
+	for _, tc := range tests {
+		args := append(append([]string{"--"}, tc.opts...), `ms=(?P<ms>\S+)`, "echo", "$ms")
+		_, stderr, code := runTea(t, input, args...)
+		if code != 0 {
+			t.Errorf("Options %q: exit status %d, stderr:\n%s", tc.opts, code, stderr)
+			continue
+		}
+		if got := strings.Join(strings.Fields(stderr), " "); got != tc.want {
+			t.Errorf("Options %q: got %q, want %q", tc.opts, got, tc.want)
+		}
+	}
+
+	// A threshold must name a submatch and give a number.
+	for _, bad := range []string{"ms", "ms=", "ms=x", "nosuch=1"} {
+		if _, _, code := runTea(t, "", "--", "-num-gt", bad, `ms=(?P<ms>\S+)`, "true"); code == 0 {
+			t.Errorf("-num-gt %q: unexpectedly succeeded", bad)
+		}
+	}
+}
+
+// stalledInput returns a pipe that delivers data and then blocks until the
+// test ends, as input from a stalled producer. It is an *os.File, so that a
+// command run with it as input does not wait for it to be closed.
+func stalledInput(t *testing.T, data string) *os.File {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pr.Close(); pw.Close() })
+	if _, err := pw.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return pr
+}
+
+func TestIdleExit(t *testing.T) {
+	cmd := teaCommand("-idle-exit", "100ms", "-ensure-newline", "-sort-output", "x", "echo", "fired")
+	timer := time.AfterFunc(10*time.Second, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+
+	// The program exits as at the end of the input, so sorted firings run and
+	// the output is finished.
+	stdout, stderr, code := runCommand(t, cmd, stalledInput(t, "x"))
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	if stdout != "x\n" {
+		t.Errorf("Output: got %q, want %q", stdout, "x\n")
+	}
+	if stderr != "fired\n" {
+		t.Errorf("Command output: got %q, want %q", stderr, "fired\n")
+	}
+}
+
+func TestMaxFiresExit(t *testing.T) {
+	cmd := teaCommand("-max-fires", "1", "-max-fires-exit", "--", "a", "echo", "A", "--", "b", "echo", "B")
+	timer := time.AfterFunc(10*time.Second, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+
+	// Once both triggers have fired, the program exits without waiting for
+	// the rest of the input.
+	stdout, stderr, code := runCommand(t, cmd, stalledInput(t, "a\na\nb\n"))
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	if stdout != "a\na\nb\n" {
+		t.Errorf("Output: got %q, want %q", stdout, "a\na\nb\n")
+	}
+	got := strings.Fields(stderr)
+	slices.Sort(got) // the triggers may fire in either order
+	if strings.Join(got, " ") != "A B" {
+		t.Errorf("Command output: got %q, want A and B once each", stderr)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	cmd := teaCommand("-fail-fast", "bad", "sh", "-c", "exit 3")
+	timer := time.AfterFunc(10*time.Second, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+
+	// The first failure stops the program without waiting for the rest of
+	// the input, and its status is the exit status.
+	stdout, stderr, code := runCommand(t, cmd, stalledInput(t, "ok\nbad\n"))
+	if code != 3 {
+		t.Errorf("Exit status: got %d, want 3; stderr:\n%s", code, stderr)
+	}
+	if stdout != "ok\nbad\n" {
+		t.Errorf("Output: got %q, want %q", stdout, "ok\nbad\n")
+	}
+
+	// A command killed by a signal has no status, so the exit status is 1.
+	if _, _, code := runTea(t, "bad\n", "-fail-fast", "bad", "sh", "-c", "kill -9 $$$$"); code != 1 {
+		t.Errorf("Killed command: got exit status %d, want 1", code)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	args := []string{"-close-timeout", "1s", "-close-kill"}
+	for range 4 {
+		args = append(args, "--", "x", "sleep", "10")
+	}
+
+	// The timeout is shared by the triggers, rather than applying to each of
+	// them in turn.
+	start := time.Now()
+	_, stderr, code := runTea(t, "x\n", args...)
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Closing took %v, want about 1s", elapsed)
+	}
+	if n := strings.Count(stderr, "did not finish"); n != 4 {
+		t.Errorf("Got %d timeout messages, want 4; stderr:\n%s", n, stderr)
+	}
+}
+
+func TestProgressCout(t *testing.T) {
+	// Stderr is not a terminal here, so automatic progress is not shown and
+	// does not need -cout.
+	if _, stderr, code := runTea(t, "x\n", "-progress", "x", "true"); code != 0 {
+		t.Errorf("With -progress: exit status %d, stderr:\n%s", code, stderr)
+	}
+	if _, _, code := runTea(t, "x\n", "-progress=always", "x", "true"); code == 0 {
+		t.Error("With -progress=always: got exit status 0, want an error for the missing -cout")
+	}
+}
+
+func TestKeepPrefixOffsets(t *testing.T) {
+	tr := &trigger{buf: bytes.NewBuffer(nil)}
+	tr.buf.Write([]byte("0123456789"))
+	check := func(want ...int64) {
+		t.Helper()
+		for i, w := range want {
+			if got := tr.inputOffset(i); got != w {
+				t.Errorf("Buffer %q: offset of %d is %d, want %d", tr.buf.Bytes(), i, got, w)
+			}
+		}
+	}
+
+	tr.cut([]int{2, 5}) // remove "234"
+	check(0, 1, 5, 6, 7, 8, 9)
+	tr.cut([]int{1, 3}) // remove "15", across the previous cut
+	check(0, 6, 7, 8, 9)
+	tr.next(1) // consume "0"
+	check(6, 7, 8, 9)
+	tr.cut([]int{2, 3}) // remove "8"
+	check(6, 7, 9)
+	tr.next(3)
+	if tr.offset != 10 || len(tr.gaps) != 0 {
+		t.Errorf("At end: offset %d, gaps %v; want 10, none", tr.offset, tr.gaps)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	record := func(name string, args []string, stdin io.Reader) error {
+		var input string
+		if stdin != nil {
+			data, err := io.ReadAll(stdin)
+			if err != nil {
+				return err
+			}
+			input = string(data)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, fmt.Sprintf("%s %q %q", name, args, input))
+		return nil
+	}
+
+	for i, rule := range [][]string{
+		{`(\w+)=(\d+)`, "echo", "$1", "$2"},
+		{`^b=`, ":cat"},
+	} {
+		tr, err := parseTrigger(rule)
+		if err != nil {
+			t.Fatalf("Parsing trigger %d: %v", i+1, err)
+		}
+		tr.id = i + 1
+		tr.runner = record
+		if _, err := io.WriteString(tr, "a=1\nb=2\n"); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := tr.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	want := []string{
+		`echo ["a" "1"] ""`,
+		`echo ["b" "2"] ""`,
+		`cat [] "b=2"`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Commands run:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestListCaptures(t *testing.T) {
+	stdout, stderr, code := runTea(t, "", "-list-captures", "-file-trigger", `(?P<dir>\w+)/x echo`, "--", `(a)(?P<b>b)`, "echo")
+	if code != 0 {
+		t.Fatalf("Exit status %d, stderr:\n%s", code, stderr)
+	}
+	const want = `Trigger 1: (a)(?P<b>b)
+  $0
+  $1
+  $2 ${b}
+File trigger 1: (?P<dir>[0-9A-Z_a-z]+)/x
+  $0
+  $1 ${dir}
+`
+	if stdout != want {
+		t.Errorf("Output: got:\n%s\nwant:\n%s", stdout, want)
+	}
+}
+
+func TestSeekTail(t *testing.T) {
+	// Lines longer than the block size of the scan, so that the scan crosses
+	// block boundaries.
+	long := strings.Repeat("x", 10000)
+	big := strings.Repeat(long+"\n", 5)
+
+	tests := []struct {
+		input string
+		n     int
+		want  string
+	}{
+		{"", 1, ""},
+		{"a", 1, "a"},
+		{"a\n", 1, "a\n"},
+		{"a\nb\nc\n", 1, "c\n"},
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 1, "c"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"\n\n\n", 2, "\n\n"},
+
+		// Fewer lines than requested.
+		{"a\nb\n", 3, "a\nb\n"},
+		{"a\nb", 5, "a\nb"},
+
+		// More than one block.
+		{big, 1, long + "\n"},
+		{big, 3, strings.Repeat(long+"\n", 3)},
+		{big, 5, big},
+		{big, 6, big},
+		{big + "end", 1, "end"},
+		{big + "end", 2, long + "\nend"},
+	}
+	path := filepath.Join(t.TempDir(), "input")
+	for _, tc := range tests {
+		if err := os.WriteFile(path, []byte(tc.input), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := seekTail(f, tc.n); err != nil {
+			t.Errorf("seekTail(%d): unexpected error: %v", tc.n, err)
+		} else if data, err := io.ReadAll(f); err != nil {
+			t.Errorf("Reading after seekTail(%d): %v", tc.n, err)
+		} else if got := string(data); got != tc.want {
+			t.Errorf("seekTail(%d) of %d bytes: got %d bytes, want %d", tc.n, len(tc.input), len(got), len(tc.want))
+			if len(tc.input) < 100 {
+				t.Logf("Input %q: got %q, want %q", tc.input, got, tc.want)
+			}
+		}
+		f.Close()
+	}
+}
+
+func TestTriggerOptionWords(t *testing.T) {
+	tests := []struct {
+		args    []string
+		pattern string
+		ok      bool
+	}{
+		{[]string{"-v", "echo"}, "-v", true},
+		{[]string{"--v", "echo"}, "--v", true},
+		{[]string{"-", "echo"}, "-", true},
+		{[]string{"-anchored", "x", "echo"}, "x", true},
+		{[]string{"-anchored", "-v", "echo"}, "-v", true},
+		{[]string{"--anchored", "x", "echo"}, "x", true},
+		{[]string{"-anchored=true", "x", "echo"}, "x", true},
+		{[]string{"-distinct", "0", "x", "echo"}, "x", true},
+		{[]string{"-distinct=0", "x", "echo"}, "x", true},
+		{[]string{"-anchored", "--", "-anchored", "echo"}, "-anchored", true},
+		{[]string{`\-anchored`, "echo"}, "-anchored", true},
+
+		{[]string{"-anchored=maybe", "x", "echo"}, "", false},
+		{[]string{"-distinct"}, "", false},
+	}
+	for _, tc := range tests {
+		tr, err := parseTrigger(tc.args)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("parseTrigger(%q): got pattern %q, want error", tc.args, tr.re)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTrigger(%q): unexpected error: %v", tc.args, err)
+		} else if got := tr.re.String(); got != tc.pattern {
+			t.Errorf("parseTrigger(%q): got pattern %q, want %q", tc.args, got, tc.pattern)
+		}
+	}
+}
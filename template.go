@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// A templateOutput writes a record for each match to a file, for -template,
+// by executing a text/template with a templateData for the match.
+type templateOutput struct {
+	tmpl *template.Template
+	out  *recordFile
+}
+
+// templateData is the value a -template is executed with for each match.
+type templateData struct {
+	Trigger int               // the trigger number
+	Match   string            // the text of the match ($0)
+	Sub     map[string]string // submatches by name, and by index
+	Source  string            // the name of the input file, or "-"
+	Line    int               // the line number in Source, or 0 in multi-line mode
+	Offset  int64             // the input offset of the match
+	Time    time.Time         // when the match was found
+	Seq     int64             // the sequence number of the firing
+}
+
+// parseOutputTemplate parses text as a -template.
+func parseOutputTemplate(text string) (*template.Template, error) {
+	return template.New("template").Option("missingkey=zero").Parse(text)
+}
+
+// record writes a record for the match x of trigger t.
+func (o *templateOutput) record(t *trigger, x *match) error {
+	data := templateData{
+		Trigger: t.id,
+		Match:   x.text[x.m[0]:x.m[1]],
+		Sub:     make(map[string]string),
+		Source:  x.source,
+		Line:    x.line,
+		Offset:  x.offset,
+		Time:    time.Now(),
+		Seq:     x.seq,
+	}
+	for i, name := range t.re.SubexpNames()[1:] {
+		val := t.submatch(strconv.Itoa(i+1), x.text, x.m)
+		data.Sub[strconv.Itoa(i+1)] = val
+		if name != "" {
+			data.Sub[name] = val
+		}
+	}
+	var buf bytes.Buffer
+	if err := o.tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	buf.WriteByte(recordEnd())
+	_, err := o.out.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A watcher polls a directory for -watch, and copies the lines appended to
+// each regular file in it to a pipe. Files present when watching begins are
+// read from their ends, as tail -F does; files that appear later, or that
+// replace a file that was rotated, are read from the beginning. Only complete
+// lines are copied, so lines from different files are not mixed.
+type watcher struct {
+	dir   string
+	every time.Duration
+	files map[string]*watchedFile // by path
+}
+
+type watchedFile struct {
+	f       *os.File
+	info    os.FileInfo // as of the last poll, to detect rotation
+	pos     int64       // the offset of the next byte to read
+	partial []byte      // an incomplete last line
+}
+
+// watchDir returns a reader for the lines appended to the files in dir,
+// which is polled every interval. The reader does not report EOF.
+func watchDir(dir string, every time.Duration) (io.Reader, error) {
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+	w := &watcher{dir: dir, every: every, files: make(map[string]*watchedFile)}
+	pr, pw := io.Pipe()
+	go func() {
+		w.poll(nil, true) // skip existing content
+		for {
+			time.Sleep(w.every)
+			if err := w.poll(pw, false); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr, nil
+}
+
+// poll checks the directory for new, rotated, and removed files, and copies
+// any new complete lines to out. If initial is true, new files are read from
+// their ends, and nothing is copied.
+func (w *watcher) poll(out io.Writer, initial bool) error {
+	ents, err := os.ReadDir(w.dir)
+	if err != nil {
+		log.Printf("Watching %q: %v", w.dir, err)
+		return nil // try again at the next poll
+	}
+	seen := make(map[string]bool)
+	for _, ent := range ents {
+		if !ent.Type().IsRegular() || strings.HasPrefix(ent.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(w.dir, ent.Name())
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue // removed since it was listed
+		}
+		seen[path] = true
+		wf := w.files[path]
+		if wf != nil && !os.SameFile(wf.info, fi) {
+			// The file was rotated: finish the old one, and start the new.
+			diag("Watch: %q was replaced", path)
+			if err := w.drain(out, wf, true); err != nil {
+				return err
+			}
+			wf.f.Close()
+			wf = nil
+		}
+		if wf == nil {
+			f, err := os.Open(path)
+			if err != nil {
+				log.Printf("Watching %q: %v", path, err)
+				continue
+			}
+			wf = &watchedFile{f: f}
+			if initial {
+				wf.pos = fi.Size()
+			}
+			diag("Watch: reading %q from offset %d", path, wf.pos)
+			w.files[path] = wf
+		} else if fi.Size() < wf.pos {
+			diag("Watch: %q was truncated", path)
+			wf.pos, wf.partial = 0, nil
+		}
+		wf.info = fi
+		if err := w.drain(out, wf, false); err != nil {
+			return err
+		}
+	}
+
+	// Finish and forget files that have been removed.
+	for path, wf := range w.files {
+		if !seen[path] {
+			diag("Watch: %q was removed", path)
+			err := w.drain(out, wf, true)
+			wf.f.Close()
+			delete(w.files, path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// drain copies the complete lines appended to wf since it was last read to
+// out. If final is true, an incomplete last line is copied too, with a newline
+// added to end it.
+func (w *watcher) drain(out io.Writer, wf *watchedFile, final bool) error {
+	if out == nil {
+		return nil
+	}
+	buf := make([]byte, 1<<16)
+	for {
+		nr, err := wf.f.ReadAt(buf, wf.pos)
+		wf.pos += int64(nr)
+		wf.partial = append(wf.partial, buf[:nr]...)
+		if err != nil {
+			break // io.EOF, or an error that will recur at the next poll
+		}
+	}
+	end := bytes.LastIndexByte(wf.partial, '\n') + 1
+	if final && end < len(wf.partial) {
+		wf.partial = append(wf.partial, '\n') // end the last line
+		end = len(wf.partial)
+	}
+	if end == 0 {
+		return nil
+	}
+	_, err := out.Write(wf.partial[:end])
+	wf.partial = append(wf.partial[:0], wf.partial[end:]...)
+	return err
+}
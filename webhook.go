@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkWebhook reports an error if s is not a valid webhook URL.
+func checkWebhook(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	} else if u.Host == "" {
+		return errors.New("missing host in URL")
+	}
+	return nil
+}
+
+// post sends the -webhook request for the match x.
+func (t *trigger) post(x *match) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *hookWait)
+	defer cancel()
+
+	body := t.expand(t.hookBody, x)
+	req, err := http.NewRequestWithContext(ctx, t.hookMethod, t.webhook, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", t.hookType)
+	for i, name := range t.re.SubexpNames() {
+		if name == "" || 2*i+1 >= len(x.m) || x.m[2*i] < 0 {
+			continue
+		}
+		// Header values cannot span lines.
+		val := strings.NewReplacer("\r", " ", "\n", " ").Replace(x.text[x.m[2*i]:x.m[2*i+1]])
+		req.Header.Set("X-Tea-Submatch-"+name, val)
+	}
+	diag("Sending %s %s (%d bytes)", req.Method, t.webhook, len(body))
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body) // so the connection can be reused
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("request failed: %s", rsp.Status)
+	}
+	return nil
+}